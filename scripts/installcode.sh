@@ -3,7 +3,7 @@ set -e
 
 user="ubuntu"
 
-while read host; do
+while read host domain; do
     ssh -i 6824.pem $user@$host "mkdir -p code \
                       && cd code \
                       && rm -rf xfertest \
@@ -12,7 +12,7 @@ user="ubuntu"
 #     ssh -i 6824.pem $user@$host "sudo apt-get -y install gcc git golang "&
 # done < servers
 
-while read host; do
+while read host domain; do
     ssh -i 6824.pem $user@$host "echo export GOPATH=/home/ubuntu/code/xfertest/ >> .bashrc "&
 done < servers
 
@@ -4,7 +4,7 @@ set -e
 user="apagan"
 
 echo "killing servers"
-while read host; do
+while read host domain; do
     ssh $user@$host ". /home/$user/code/xfertest/scripts/killservers.sh" &
 done < servers
 wait
@@ -16,6 +16,7 @@ import (
   "strconv"
   "math/rand"
   "io"
+  "sort"
 )
 
 var vs_idx = 0
@@ -30,6 +31,12 @@ var repl       = flag.Bool("repl", false, "run a repl")
 var me         = flag.Int("me", -1, "who am I")
 var bench      = flag.Int("bench", -1, "run a benchmark")
 var hostfile   = flag.String("hosts", "", "File containing the names of servers in the cluster")
+var vsreplicas = flag.Int("vsreplicas", 1, "number of hosts, starting with node 0, that run a viewservice replica")
+var allowloss  = flag.Bool("allowloss", false, "recover shards even if some of their log segments are lost")
+var eventlog   = flag.String("eventlog", "", "also keep the viewservice's cluster events in this file")
+var capacity   = flag.Int64("capacity", 0, "MB of memory this server has for its store, for placing shards (0 for unknown)")
+var maxrms     = flag.Int("maxrms", -1, "max number of recovery masters at once (0 for no limit, -1 for the config's default)")
+var configfile = flag.String("config", "", "JSON file with the cluster's parameters; every node must use the same one")
 
 func printStats(samples []int64) {
   var sum int64 = 0
@@ -60,8 +67,11 @@ func reportError(error interface{}) {
   fmt.Printf("Error opening hosts file: %v", error)
 }
 
-func readHosts() []string {
+// one host per line, optionally followed by the failure domain (rack, zone)
+// it is in. returns the hosts and their domains, "" where none is given.
+func readHosts() ([]string, []string) {
   hosts := make([]string, 0)
+  domains := make([]string, 0)
 
   var filepath string
 
@@ -85,9 +95,18 @@ func readHosts() []string {
     if err != nil {
       break
     }
-    hosts = append(hosts, strings.Trim(str, " \n"))
+    fields := strings.Fields(str)
+    host, domain := "", ""
+    if len(fields) > 0 {
+      host = fields[0]
+    }
+    if len(fields) > 1 {
+      domain = fields[1]
+    }
+    hosts = append(hosts, host)
+    domains = append(domains, domain)
   }
-  return hosts
+  return hosts, domains
 }
 
 type randomDataMaker struct {
@@ -112,6 +131,62 @@ func (r *randomDataMaker) Read(p []byte) (n int, err error) {
     panic("unreachable")
 }
 
+// one line per shard being (or recently) recovered, by dead server
+func printRecoveries(recoveries map[string]map[int]viewservice.ShardRecovery) {
+  servers := make([]string, 0)
+  for server, _ := range recoveries {
+    servers = append(servers, server)
+  }
+  sort.Strings(servers)
+
+  for _, server := range servers {
+    fmt.Printf("Recovery of %s:\n", server)
+    fmt.Printf("  %5s  %-22s %9s %10s %10s %10s\n", "shard", "recovery master", "segments", "MB", "elapsed", "eta")
+
+    shards := make([]int, 0)
+    for shard, _ := range recoveries[server] {
+      shards = append(shards, shard)
+    }
+    sort.Ints(shards)
+
+    for _, shard := range shards {
+      p := recoveries[server][shard]
+      eta := "-"
+      if p.Done {
+        eta = "done"
+      } else if p.ETA > 0 {
+        eta = p.ETA.String()
+      }
+      fmt.Printf("  %5d  %-22s %4d/%-4d %10.2f %10v %10s\n", shard, p.RecoveryMaster,
+        p.SegmentsFetched, p.SegmentsNeeded, float64(p.BytesReplayed) / (1024 * 1024),
+        p.Elapsed.Round(time.Millisecond), eta)
+    }
+  }
+}
+
+
+// how this server should be started, from the hosts file and flags
+func serverOptions(domain string) pbservice.ServerOptions {
+  opts := pbservice.ServerOptions{}
+  opts.Domain = domain
+  opts.Capacity = *capacity * 1024 * 1024
+  return opts
+}
+
+// the cluster's parameters, from -config if given
+func readConfig() viewservice.Config {
+  if *configfile == "" {
+    return viewservice.DefaultConfig()
+  }
+  config, err := viewservice.LoadConfig(*configfile)
+  if err != nil {
+    fmt.Println("Bad config: ", err)
+    os.Exit(1)
+  }
+  return config
+}
+
+
 func main() {
 
   runtime.GOMAXPROCS(8)
@@ -125,9 +200,19 @@ func main() {
     defer pprof.StopCPUProfile()
   }
 
-  hosts := readHosts()
+  hosts, domains := readHosts()
+  config := readConfig()
 
-  vshostname := hosts[0] + vsport
+  // the first vsreplicas hosts each run a viewservice replica
+  if *vsreplicas < 1 || *vsreplicas > len(hosts) {
+    fmt.Println("Bad number of viewservice replicas: ", *vsreplicas)
+    os.Exit(1)
+  }
+  vsreplicahosts := make([]string, *vsreplicas)
+  for i := 0; i < *vsreplicas; i++ {
+    vsreplicahosts[i] = hosts[i] + vsport
+  }
+  vshostname := strings.Join(vsreplicahosts, ",")
 
   if *repl {
     reader := bufio.NewReader(os.Stdin)
@@ -160,6 +245,52 @@ func main() {
                 reportTiming(t2-t1)
               }
             }
+          case "DEL":
+            if len(input) == 2 {
+              t1 := time.Now().UnixNano()
+              ck.Delete(input[1])
+              t2 := time.Now().UnixNano()
+              if timing {
+                reportTiming(t2-t1)
+              }
+            }
+          case "SCAN":
+            // SCAN prefix, or SCAN start end [pagesize] with - for no bound
+            if len(input) >= 2 && len(input) <= 4 {
+              start, end, limit := input[1], "", 100
+              if len(input) == 2 {
+                end = pbservice.PrefixEnd(start)
+              } else {
+                end = input[2]
+                if len(input) == 4 {
+                  limit, err = strconv.Atoi(input[3])
+                }
+                if start == "-" {
+                  start = ""
+                }
+                if end == "-" {
+                  end = ""
+                }
+              }
+              t1 := time.Now().UnixNano()
+              n := 0
+              for err == nil {
+                pairs, next := ck.Scan(start, end, limit)
+                for _, kv := range pairs {
+                  fmt.Println(kv.Key, kv.Value)
+                }
+                n += len(pairs)
+                if next == "" {
+                  break
+                }
+                start = next
+              }
+              t2 := time.Now().UnixNano()
+              fmt.Printf("%d keys\n", n)
+              if timing {
+                reportTiming(t2-t1)
+              }
+            }
           case "TIMING":
             timing = !timing
             if timing {
@@ -182,7 +313,76 @@ func main() {
               }
             }
           case "STATUS":
-            fmt.Println(ck.Status().ServersAlive)
+            status := ck.Status()
+            fmt.Println(status.ServersAlive)
+            for shard, destination := range status.Migrations {
+              fmt.Printf("Moving shard %d to %s\n", shard, destination)
+            }
+            for server, _ := range status.Draining {
+              fmt.Printf("Draining %s\n", server)
+            }
+            for server, _ := range status.Decommissioned {
+              fmt.Printf("Decommissioned %s\n", server)
+            }
+            for server, segments := range status.LostSegments {
+              fmt.Printf("!!! %s lost %d log segments: %v\n", server, len(segments), segments)
+            }
+            printRecoveries(status.Recoveries)
+          case "EVENTS":
+            n := 20
+            if len(input) == 2 {
+              n, err = strconv.Atoi(input[1])
+            }
+            if err == nil {
+              events := ck.Events(-1)
+              if len(events) > n {
+                events = events[len(events)-n:]
+              }
+              for _, event := range events {
+                fmt.Println(event)
+              }
+            }
+          case "MOVE":
+            if len(input) == 3 {
+              shard, err1 := strconv.Atoi(input[1])
+              srv, err2   := strconv.Atoi(input[2])
+              if err1 == nil && err2 == nil {
+                if srv >= 0 && srv < len(hosts) {
+                  fmt.Println(ck.MoveShard(shard, hosts[srv] + kvport))
+                } else {
+                  fmt.Println("Server index out of bounds: ", srv)
+                }
+              }
+            }
+          case "SPLIT":
+            if len(input) == 2 || len(input) == 3 {
+              shard, err := strconv.Atoi(input[1])
+              key := ""
+              if len(input) == 3 {
+                key = input[2]
+              }
+              if err == nil {
+                fmt.Println(ck.SplitShard(shard, key))
+              }
+            }
+          case "MERGE":
+            if len(input) == 2 {
+              shard, err := strconv.Atoi(input[1])
+              if err == nil {
+                fmt.Println(ck.MergeShards(shard))
+              }
+            }
+          case "DRAIN":
+            if len(input) == 2 {
+              srv, err := strconv.Atoi(input[1])
+              if err == nil {
+                if srv >= 0 && srv < len(hosts) {
+                  fmt.Println(ck.Drain(hosts[srv] + kvport))
+                } else {
+                  fmt.Println("Server index out of bounds: ", srv)
+                }
+              }
+            }
           case "KILL":
             if len(input) == 2 {
               srv, err := strconv.Atoi(input[1])
@@ -195,25 +395,39 @@ func main() {
               }
             }
           case "PUTS":
+            // PUTS valsize numofputs [batchsize]
             msg := "Executing a bunch of puts."
-            if len(input) == 3 {
+            if len(input) == 3 || len(input) == 4 {
               fmt.Println("STARTING: ", msg)
               valsize, err1   := strconv.Atoi(input[1])
               numofputs, err2 := strconv.Atoi(input[2])
-              if err1 == nil && err2 == nil {
+              batchsize, err3 := 1, error(nil)
+              if len(input) == 4 {
+                batchsize, err3 = strconv.Atoi(input[3])
+              }
+              if err1 == nil && err2 == nil && err3 == nil && batchsize > 0 {
                 go func() {
-                  times := make([]int64, numofputs)
+                  times := make([]int64, 0)
                   ck := pbservice.MakeClerk("", vshostname, mode)
                   var valBuf bytes.Buffer
 
                   io.CopyN(&valBuf, &randomSrc, int64(valsize))
 
-                  for i:=0; i < numofputs; i++ {
+                  // times are per put, or per batch of them
+                  for i:=0; i < numofputs; i += batchsize {
                     t1 := time.Now().UnixNano()
-                    ck.Put(fmt.Sprintf("%d", t1), valBuf.String())
+                    if batchsize == 1 {
+                      ck.Put(fmt.Sprintf("%d", t1), valBuf.String())
+                    } else {
+                      batch := make([]pbservice.KeyValue, 0)
+                      for j := i; j < i + batchsize && j < numofputs; j++ {
+                        batch = append(batch, pbservice.KeyValue{Key: fmt.Sprintf("%d-%d", t1, j), Value: valBuf.String()})
+                      }
+                      ck.MultiPut(batch)
+                    }
                     t2 := time.Now().UnixNano()
-                    times[i] = t2-t1
-                    if i % 100 == 0 {
+                    times = append(times, t2-t1)
+                    if i % 100 < batchsize {
                       fmt.Println("\nFinished ", i)
                     }
                   }
@@ -234,17 +448,27 @@ func main() {
     os.Exit(0)
   }
 
-  if *me == 0 {
+  if *me >= 0 && *me < *vsreplicas {
 
     go func() {
 
-      // NODE 0 is special: start the viewserver too
-      fmt.Println("Starting Viewserver on ", vshostname)
-      viewservice.StartMe(vshostname, mode)
+      // the first few nodes are special: start a viewserver replica too
+      fmt.Println("Starting Viewserver on ", vsreplicahosts[*me])
+      vs := viewservice.StartReplica(vsreplicahosts, *me, mode, config)
+
+      policy := config.PlacementPolicy()
+      if *maxrms >= 0 {
+        policy.MaxRecoveryMasters = *maxrms
+      }
+      vs.SetPlacementPolicy(policy)
+      vs.SetAllowDataLoss(*allowloss)
+      if *eventlog != "" {
+        vs.SetEventLog(*eventlog)
+      }
 
       hostname := hosts[*me] + kvport
       fmt.Println("Starting KV Server on ", hostname)
-      pbservice.StartMe(hostname, vshostname, mode)
+      pbservice.StartWithOptions(hostname, vshostname, mode, config, serverOptions(domains[*me]))
 
     }()
 
@@ -253,7 +477,7 @@ func main() {
     go func() {
       hostname := hosts[*me] + kvport
       fmt.Println("Starting KV Server on ", hostname)
-      pbservice.StartMe(hostname, vshostname, mode)
+      pbservice.StartWithOptions(hostname, vshostname, mode, config, serverOptions(domains[*me]))
     }()
 
   } else {
@@ -0,0 +1,660 @@
+package paxos
+
+//
+// Paxos library, to be included in an application.
+// Multiple applications will run, each including
+// a Paxos peer.
+//
+// Manages a sequence of agreed-on values.
+// The set of peers is fixed.
+// Copes with network failures (partition, msg loss, &c).
+// A peer made with MakeDurable writes its acceptor state to disk before
+// answering, so it can crash and restart; one made with Make can't.
+// Either way applications are expected to keep their own durable record
+// of the values they have applied.
+//
+// px = paxos.Make(peers []string, me int, rpcs, networkMode)
+// px = paxos.MakeDurable(peers []string, me int, rpcs, networkMode, fname)
+// px.Start(seq int, v interface{}) -- start agreement on new instance
+// px.Status(seq int) (decided bool, v interface{}) -- get info about an instance
+// px.Done(seq int) -- ok to forget all instances <= seq
+// px.Max() int -- highest instance seq known, or -1
+// px.Min() int -- instances before this seq have been forgotten
+//
+
+import (
+  "bytes"
+  "net"
+  "net/rpc"
+  "encoding/gob"
+  "log"
+  "os"
+  "path"
+  "strings"
+  "sync"
+  "fmt"
+  "math/rand"
+  "time"
+)
+
+
+type Paxos struct {
+  mu sync.Mutex
+  l net.Listener
+  dead bool
+  peers []string
+  me int // index into peers[]
+  networkMode string
+
+  instances map[int]*Instance
+  maxSeq int
+
+  // highest seq passed to Done() by each peer, as far as we know
+  done []int
+
+  // acceptor state goes here before we answer a prepare or accept, so
+  // that a restarted peer keeps its promises. "" if we don't keep any.
+  fname string
+  file *os.File
+  enc *gob.Encoder
+  written int       // records in file
+}
+
+// the file of acceptor state is rewritten with just the instances still
+// remembered once it holds this many records
+const COMPACT_AFTER = 1000
+
+// acceptor state for a single sequence number, as kept on disk. later
+// records for a seq replace earlier ones.
+type acceptorRecord struct {
+  Seq int
+  Np int64
+  Na int64
+  Va interface{}
+}
+
+// acceptor and learner state for a single sequence number
+type Instance struct {
+  Np int64           // highest prepare seen
+  Na int64           // highest accept seen
+  Va interface{}     // value of highest accept
+  Decided bool
+  Value interface{}
+}
+
+
+type PrepareArgs struct {
+  Seq int
+  N int64
+  Me int
+  Done int
+}
+
+type PrepareReply struct {
+  OK bool
+  Np int64
+  Na int64
+  Va interface{}
+  Done int
+}
+
+type AcceptArgs struct {
+  Seq int
+  N int64
+  V interface{}
+  Me int
+  Done int
+}
+
+type AcceptReply struct {
+  OK bool
+  Np int64
+  Done int
+}
+
+type DecidedArgs struct {
+  Seq int
+  V interface{}
+  Me int
+  Done int
+}
+
+type DecidedReply struct {
+  Done int
+}
+
+
+func call(srv string, name string, networkMode string, args interface{}, reply interface{}) bool {
+  c, err := rpc.Dial(networkMode, srv)
+  if err != nil {
+    return false
+  }
+  defer c.Close()
+
+  err = c.Call(name, args, reply)
+  if err == nil {
+    return true
+  }
+  return false
+}
+
+
+// returns the instance for seq, creating it if need be. callers must hold px.mu.
+func (px *Paxos) instance(seq int) *Instance {
+  inst, ok := px.instances[seq]
+  if ! ok {
+    inst = new(Instance)
+    px.instances[seq] = inst
+    if seq > px.maxSeq {
+      px.maxSeq = seq
+    }
+  }
+  return inst
+}
+
+
+// records the Done value piggybacked on a message from peer.
+// callers must hold px.mu.
+func (px *Paxos) heardDone(peer int, done int) {
+  if done > px.done[peer] {
+    px.done[peer] = done
+  }
+  px.forget()
+}
+
+
+// frees instances every peer is done with. callers must hold px.mu.
+func (px *Paxos) forget() {
+  min := px.min()
+  for seq, _ := range px.instances {
+    if seq < min {
+      delete(px.instances, seq)
+    }
+  }
+}
+
+
+func (px *Paxos) Prepare(args *PrepareArgs, reply *PrepareReply) error {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+
+  px.heardDone(args.Me, args.Done)
+  reply.Done = px.done[px.me]
+
+  inst := px.instance(args.Seq)
+  if args.N > inst.Np {
+    inst.Np = args.N
+    reply.OK = px.persist(args.Seq, inst)
+    reply.Na = inst.Na
+    reply.Va = inst.Va
+  } else {
+    reply.OK = false
+  }
+  reply.Np = inst.Np
+
+  return nil
+}
+
+
+func (px *Paxos) Accept(args *AcceptArgs, reply *AcceptReply) error {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+
+  px.heardDone(args.Me, args.Done)
+  reply.Done = px.done[px.me]
+
+  inst := px.instance(args.Seq)
+  if args.N >= inst.Np {
+    inst.Np = args.N
+    inst.Na = args.N
+    inst.Va = args.V
+    reply.OK = px.persist(args.Seq, inst)
+  } else {
+    reply.OK = false
+  }
+  reply.Np = inst.Np
+
+  return nil
+}
+
+
+func (px *Paxos) Decided(args *DecidedArgs, reply *DecidedReply) error {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+
+  px.heardDone(args.Me, args.Done)
+  reply.Done = px.done[px.me]
+
+  if args.Seq < px.min() {
+    return nil
+  }
+
+  inst := px.instance(args.Seq)
+  inst.Decided = true
+  inst.Value = args.V
+
+  return nil
+}
+
+
+// durably records the acceptor state for seq. returns false if it couldn't
+// be written, in which case the caller mustn't answer OK. callers must hold
+// px.mu.
+func (px *Paxos) persist(seq int, inst *Instance) bool {
+  if px.fname == "" {
+    return true
+  }
+
+  if px.written >= COMPACT_AFTER {
+    err := px.compact()
+    if err != nil {
+      fmt.Printf("Paxos(%v) compact: %v\n", px.me, err)
+    }
+  }
+
+  err := px.enc.Encode(acceptorRecord{Seq: seq, Np: inst.Np, Na: inst.Na, Va: inst.Va})
+  if err == nil {
+    err = px.file.Sync()
+  }
+  if err != nil {
+    fmt.Printf("Paxos(%v) persist: %v\n", px.me, err)
+    // the tail of the file may be torn; start a clean one next time
+    px.written = COMPACT_AFTER
+    return false
+  }
+  px.written++
+  return true
+}
+
+
+// replaces the file of acceptor state with one holding just the instances
+// we still remember. callers must hold px.mu.
+func (px *Paxos) compact() error {
+  tmp := px.fname + ".tmp"
+  fo, err := os.Create(tmp)
+  if err != nil {
+    return err
+  }
+
+  enc := gob.NewEncoder(fo)
+  written := 0
+  for seq, inst := range px.instances {
+    if inst.Np == 0 {
+      // never promised anything
+      continue
+    }
+    err = enc.Encode(acceptorRecord{Seq: seq, Np: inst.Np, Na: inst.Na, Va: inst.Va})
+    if err != nil {
+      break
+    }
+    written++
+  }
+  if err == nil {
+    err = fo.Sync()
+  }
+  if err == nil {
+    err = os.Rename(tmp, px.fname)
+  }
+  if err == nil {
+    err = syncDir(path.Dir(px.fname))
+  }
+  if err != nil {
+    fo.Close()
+    return err
+  }
+
+  if px.file != nil {
+    px.file.Close()
+  }
+  px.file = fo
+  px.enc = enc
+  px.written = written
+  return nil
+}
+
+
+// makes a rename in dir durable
+func syncDir(dir string) error {
+  d, err := os.Open(dir)
+  if err != nil {
+    return err
+  }
+  defer d.Close()
+  return d.Sync()
+}
+
+
+// reads back the acceptor state a previous run of this peer left behind,
+// and starts a fresh file with it. a torn write at the tail just ends the
+// replay.
+func (px *Paxos) restore() error {
+  fo, err := os.Open(px.fname)
+  if err == nil {
+    dec := gob.NewDecoder(fo)
+    for {
+      var record acceptorRecord
+      if dec.Decode(&record) != nil {
+        break
+      }
+      inst := px.instance(record.Seq)
+      inst.Np = record.Np
+      inst.Na = record.Na
+      inst.Va = record.Va
+    }
+    fo.Close()
+  }
+
+  os.MkdirAll(path.Dir(px.fname), 0777)
+  return px.compact()
+}
+
+
+// a proposal number higher than any we've seen for seq, unique to this peer
+func (px *Paxos) nextProposal(seen int64) int64 {
+  n := int64(len(px.peers))
+  return (seen / n + 1) * n + int64(px.me)
+}
+
+
+// drives instance seq to a decision, proposing v if nobody else got there first
+func (px *Paxos) propose(seq int, v interface{}) {
+
+  var seen int64 = 0
+  majority := len(px.peers) / 2 + 1
+
+  for px.dead == false {
+
+    px.mu.Lock()
+    if seq < px.min() {
+      px.mu.Unlock()
+      return
+    }
+    inst := px.instance(seq)
+    if inst.Decided {
+      px.mu.Unlock()
+      return
+    }
+    if inst.Np > seen {
+      seen = inst.Np
+    }
+    done := px.done[px.me]
+    px.mu.Unlock()
+
+    n := px.nextProposal(seen)
+
+    // phase 1: prepare
+    prepareArgs := &PrepareArgs{Seq: seq, N: n, Me: px.me, Done: done}
+    prepared := 0
+    var highestNa int64 = 0
+    value := v
+
+    for i, peer := range px.peers {
+      reply := new(PrepareReply)
+      ok := true
+      if i == px.me {
+        px.Prepare(prepareArgs, reply)
+      } else {
+        ok = call(peer, "Paxos.Prepare", px.networkMode, prepareArgs, reply)
+      }
+      if ok {
+        px.mu.Lock()
+        px.heardDone(i, reply.Done)
+        px.mu.Unlock()
+
+        if reply.OK {
+          prepared++
+          if reply.Na > highestNa {
+            highestNa = reply.Na
+            value = reply.Va
+          }
+        }
+        if reply.Np > seen {
+          seen = reply.Np
+        }
+      }
+    }
+
+    if prepared >= majority {
+
+      // phase 2: accept
+      acceptArgs := &AcceptArgs{Seq: seq, N: n, V: value, Me: px.me, Done: done}
+      accepted := 0
+
+      for i, peer := range px.peers {
+        reply := new(AcceptReply)
+        ok := true
+        if i == px.me {
+          px.Accept(acceptArgs, reply)
+        } else {
+          ok = call(peer, "Paxos.Accept", px.networkMode, acceptArgs, reply)
+        }
+        if ok {
+          if reply.OK {
+            accepted++
+          }
+          if reply.Np > seen {
+            seen = reply.Np
+          }
+        }
+      }
+
+      if accepted >= majority {
+
+        // phase 3: tell everybody
+        decidedArgs := &DecidedArgs{Seq: seq, V: value, Me: px.me, Done: done}
+        for i, peer := range px.peers {
+          reply := new(DecidedReply)
+          if i == px.me {
+            px.Decided(decidedArgs, reply)
+          } else if call(peer, "Paxos.Decided", px.networkMode, decidedArgs, reply) {
+            px.mu.Lock()
+            px.heardDone(i, reply.Done)
+            px.mu.Unlock()
+          }
+        }
+        return
+      }
+    }
+
+    // back off so that dueling proposers eventually let one through
+    time.Sleep(time.Duration(rand.Int63() % 100) * time.Millisecond)
+  }
+}
+
+
+//
+// the application wants paxos to start agreement on
+// instance seq, with proposed value v.
+// Start() returns right away; the application will
+// call Status() to find out if/when agreement
+// is reached.
+//
+func (px *Paxos) Start(seq int, v interface{}) {
+  go px.propose(seq, copyValue(v))
+}
+
+
+//
+// the application on this machine is done with
+// all instances <= seq.
+//
+func (px *Paxos) Done(seq int) {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+
+  if seq > px.done[px.me] {
+    px.done[px.me] = seq
+  }
+  px.forget()
+}
+
+
+//
+// the application wants to know the
+// highest instance sequence known to
+// this peer.
+//
+func (px *Paxos) Max() int {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  return px.maxSeq
+}
+
+
+//
+// instances before this seq have been forgotten (or may be, by some peer).
+// callers must hold px.mu.
+//
+func (px *Paxos) min() int {
+  min := px.done[px.me]
+  for _, done := range px.done {
+    if done < min {
+      min = done
+    }
+  }
+  return min + 1
+}
+
+func (px *Paxos) Min() int {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  return px.min()
+}
+
+
+//
+// the application wants to know whether this
+// peer thinks an instance has been decided,
+// and if so what the agreed value is. Status()
+// should just inspect the local peer state;
+// it should not contact other Paxos peers.
+//
+func (px *Paxos) Status(seq int) (bool, interface{}) {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+
+  inst, ok := px.instances[seq]
+  if ! ok || ! inst.Decided {
+    return false, nil
+  }
+  return true, copyValue(inst.Value)
+}
+
+
+// a deep copy of v, made by a gob round trip like the one values take to
+// other peers. calls to ourselves don't go over the network, so without it
+// the application could change a value after proposing it, or change what
+// we hand out as decided.
+func copyValue(v interface{}) interface{} {
+  if v == nil {
+    return nil
+  }
+
+  var buf bytes.Buffer
+  err := gob.NewEncoder(&buf).Encode(&v)
+  if err == nil {
+    var c interface{}
+    err = gob.NewDecoder(&buf).Decode(&c)
+    if err == nil {
+      return c
+    }
+  }
+  fmt.Printf("Paxos copy of %T: %v\n", v, err)
+  return v
+}
+
+
+//
+// tell the peer to shut itself down.
+// for testing.
+//
+func (px *Paxos) Kill() {
+  px.dead = true
+  if px.l != nil {
+    px.l.Close()
+  }
+
+  px.mu.Lock()
+  if px.file != nil {
+    px.file.Close()
+    px.file = nil
+  }
+  px.mu.Unlock()
+}
+
+
+//
+// the application wants to create a paxos peer.
+// the ports of all the paxos peers (including this one)
+// are in peers[]. this servers port is peers[me].
+// if rpcs is nil, paxos listens on peers[me] itself; otherwise it
+// registers with the application's rpc server.
+//
+func Make(peers []string, me int, rpcs *rpc.Server, networkMode string) *Paxos {
+  return MakeDurable(peers, me, rpcs, networkMode, "")
+}
+
+//
+// like Make, but the peer keeps its acceptor state in fname, and picks up
+// whatever is there from before it crashed. "" keeps nothing.
+//
+func MakeDurable(peers []string, me int, rpcs *rpc.Server, networkMode string, fname string) *Paxos {
+  px := &Paxos{}
+  px.peers = peers
+  px.me = me
+  px.networkMode = networkMode
+
+  px.instances = make(map[int]*Instance)
+  px.maxSeq = -1
+  px.done = make([]int, len(peers))
+  for i, _ := range px.done {
+    px.done[i] = -1
+  }
+
+  px.fname = fname
+  if fname != "" {
+    err := px.restore()
+    if err != nil {
+      log.Fatal("paxos state: ", err)
+    }
+  }
+
+  if rpcs != nil {
+    // caller will create socket &c
+    rpcs.Register(px)
+  } else {
+    rpcs = rpc.NewServer()
+    rpcs.Register(px)
+
+    hostname := peers[me]
+    if networkMode == "unix" {
+      os.Remove(hostname)
+    } else if networkMode == "tcp" {
+      arr := strings.Split(hostname, ":")
+      hostname = ":" + arr[1]
+    }
+
+    l, e := net.Listen(networkMode, hostname);
+    if e != nil {
+      log.Fatal("listen error: ", e);
+    }
+    px.l = l
+
+    // create a thread to accept RPC connections
+    go func() {
+      for px.dead == false {
+        conn, err := px.l.Accept()
+        if err == nil && px.dead == false {
+          go rpcs.ServeConn(conn)
+        } else if err == nil {
+          conn.Close()
+        }
+        if err != nil && px.dead == false {
+          fmt.Printf("Paxos(%v) accept: %v\n", me, err.Error())
+        }
+      }
+    }()
+  }
+
+  return px
+}
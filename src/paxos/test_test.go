@@ -0,0 +1,194 @@
+package paxos
+
+import "testing"
+import "runtime"
+import "strconv"
+import "os"
+import "time"
+import "fmt"
+import "net/rpc"
+
+func port(tag string, host int) string {
+  s := "/var/tmp/824-"
+  s += strconv.Itoa(os.Getuid()) + "/"
+  os.Mkdir(s, 0777)
+  s += "px-"
+  s += strconv.Itoa(os.Getpid()) + "-"
+  s += tag + "-"
+  s += strconv.Itoa(host)
+  return s
+}
+
+func ndecided(t *testing.T, pxa []*Paxos, seq int) int {
+  count := 0
+  var v interface{}
+  for i := 0; i < len(pxa); i++ {
+    if pxa[i] != nil {
+      decided, v1 := pxa[i].Status(seq)
+      if decided {
+        if count > 0 && v != v1 {
+          t.Fatalf("decided values do not match; seq=%v i=%v v=%v v1=%v",
+            seq, i, v, v1)
+        }
+        count++
+        v = v1
+      }
+    }
+  }
+  return count
+}
+
+func waitn(t *testing.T, pxa[]*Paxos, seq int, wanted int) {
+  to := 10 * time.Millisecond
+  for iters := 0; iters < 30; iters++ {
+    if ndecided(t, pxa, seq) >= wanted {
+      break
+    }
+    time.Sleep(to)
+    if to < time.Second {
+      to *= 2
+    }
+  }
+  nd := ndecided(t, pxa, seq)
+  if nd < wanted {
+    t.Fatalf("too few decided; seq=%v ndecided=%v wanted=%v", seq, nd, wanted)
+  }
+}
+
+func cleanup(pxa []*Paxos) {
+  for i := 0; i < len(pxa); i++ {
+    if pxa[i] != nil {
+      pxa[i].Kill()
+    }
+  }
+}
+
+func TestBasic(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("basic", i)
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = Make(pxh, i, nil, "unix")
+  }
+
+  fmt.Printf("Test: Single proposer ...\n")
+
+  pxa[0].Start(0, "hello")
+  waitn(t, pxa, 0, npaxos)
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Many proposers, same value ...\n")
+
+  for i := 0; i < npaxos; i++ {
+    pxa[i].Start(1, 77)
+  }
+  waitn(t, pxa, 1, npaxos)
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Many proposers, different values ...\n")
+
+  pxa[0].Start(2, 100)
+  pxa[1].Start(2, 101)
+  pxa[2].Start(2, 102)
+  waitn(t, pxa, 2, npaxos)
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Minority failure ...\n")
+
+  pxa[2].Kill()
+  pxa[2] = nil
+  pxa[0].Start(3, "still here")
+  waitn(t, pxa, 3, npaxos - 1)
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Forgetting ...\n")
+
+  for i := 0; i < npaxos - 1; i++ {
+    pxa[i].Done(1)
+  }
+  pxa[1].Start(4, "forget")
+  waitn(t, pxa, 4, npaxos - 1)
+
+  // the dead peer never said it was done, so nothing can be forgotten
+  if pxa[0].Min() != 0 {
+    t.Fatalf("forgot too much; min=%v", pxa[0].Min())
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Decided values can't be changed ...\n")
+
+  // the proposer keeps a reference to what it proposed
+  v := []int{1}
+  pxa[0].Start(5, v)
+  v[0] = 2
+
+  decided := false
+  for iters := 0; iters < 30 && ! decided; iters++ {
+    time.Sleep(10 * time.Millisecond)
+    decided, _ = pxa[0].Status(5)
+  }
+  if ! decided {
+    t.Fatalf("seq 5 was never decided")
+  }
+  _, v1 := pxa[0].Status(5)
+  v1.([]int)[0] = 3
+  if _, v2 := pxa[0].Status(5); v2.([]int)[0] != 1 {
+    t.Fatalf("decided value changed to %v", v2)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestRestart(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 3
+  var pxh []string = make([]string, npaxos)
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("restart", i)
+  }
+  fname := port("restart-state", 0)
+  os.Remove(fname)
+
+  fmt.Printf("Test: A restarted acceptor keeps its promises ...\n")
+
+  px := MakeDurable(pxh, 0, rpc.NewServer(), "unix", fname)
+
+  prepared := new(PrepareReply)
+  px.Prepare(&PrepareArgs{Seq: 0, N: 5, Me: 1, Done: -1}, prepared)
+  accepted := new(AcceptReply)
+  px.Accept(&AcceptArgs{Seq: 0, N: 5, V: "five", Me: 1, Done: -1}, accepted)
+  px.Prepare(&PrepareArgs{Seq: 1, N: 7, Me: 2, Done: -1}, prepared)
+  if ! prepared.OK || ! accepted.OK {
+    t.Fatalf("fresh acceptor turned down a proposal")
+  }
+  px.Kill()
+
+  px = MakeDurable(pxh, 0, rpc.NewServer(), "unix", fname)
+  defer px.Kill()
+
+  reply := new(PrepareReply)
+  px.Prepare(&PrepareArgs{Seq: 1, N: 6, Me: 1, Done: -1}, reply)
+  if reply.OK {
+    t.Fatalf("restarted acceptor forgot it promised 7")
+  }
+  reply = new(PrepareReply)
+  px.Prepare(&PrepareArgs{Seq: 0, N: 8, Me: 2, Done: -1}, reply)
+  if ! reply.OK || reply.Na != 5 || reply.Va != "five" {
+    t.Fatalf("restarted acceptor forgot what it accepted: %v", reply)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
@@ -0,0 +1,56 @@
+package pbservice
+
+
+// puts a batch of keys, all committed together. keys we don't serve get
+// ErrWrongServer. the puts are logged in the order they come in, and
+// the batch stops at the first one that can't be, so what is in the log is
+// always the first part of the batch; a retry of the rest then carries
+// later requests than anything logged, which keeps duplicate detection
+// exact.
+func (pb *PBServer) MultiPut(args *MultiPutArgs, reply *MultiPutReply) error {
+  stopped := false
+  writes  := make([]*write, len(args.Puts))
+  for i, put := range args.Puts {
+    writes[i] = &write{stop: &stopped}
+    writes[i].op = Op{Client: put.Client, Request: put.Request, Type: PutOp, Key: put.Key, Value: put.Value}
+  }
+
+  pb.submit(writes...)
+
+  reply.Errs = make([]Err, len(args.Puts))
+  for i, w := range writes {
+    reply.Errs[i] = w.err
+  }
+  return nil
+}
+
+
+// gets a batch of keys; keys we don't serve get ErrWrongServer
+func (pb *PBServer) MultiGet(args *MultiGetArgs, reply *MultiGetReply) error {
+  pb.mu.Lock()
+  defer pb.mu.Unlock()
+
+  reply.Values = make([]string, len(args.Keys))
+  reply.Errs   = make([]Err, len(args.Keys))
+
+  valid := pb.leaseValid()
+  for i, key := range args.Keys {
+    if ! pb.servesShard(pb.view.ShardForKey(key)) {
+      reply.Errs[i] = ErrWrongServer
+      continue
+    }
+    if ! valid {
+      reply.Errs[i] = ErrNoLease
+      continue
+    }
+
+    op, ok := pb.store[key]
+    if ! ok || op.Type == DeleteOp {
+      reply.Errs[i] = ErrNoKey
+      continue
+    }
+    reply.Values[i] = op.Value
+    reply.Errs[i] = OK
+  }
+  return nil
+}
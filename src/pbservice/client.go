@@ -11,10 +11,16 @@ import (
   "viewservice"
   "net/rpc"
   "fmt"
+  "sort"
+  "sync"
   "time"
-  "hash/adler32"
+  "crypto/rand"
+  "math/big"
 )
 
+// number of times a clerk retries a Get
+const Retries = 5
+
 // clerk for the pbservice which encapsulates a viewservice clerk
 type Clerk struct {
   vs *viewservice.Clerk
@@ -30,9 +36,28 @@ func MakeClerk(me string, vshost string, networkMode string) *Clerk {
   ck := new(Clerk)
   ck.vs = viewservice.MakeClerk(me, vshost, networkMode)
   ck.networkMode = networkMode
+  ck.ClientID = nrand()
   return ck
 }
 
+// has the clerk wait on the viewservice for the config's ping interval
+// rather than the default one.
+func (ck *Clerk) SetConfig(config viewservice.Config) {
+  ck.vs.SetConfig(config)
+}
+
+// a random client id; servers take 0 to mean there is no client to tell
+// retries apart for
+func nrand() int64 {
+  max := big.NewInt(int64(1) << 62)
+  for {
+    x, _ := rand.Int(rand.Reader, max)
+    if x.Int64() != 0 {
+      return x.Int64()
+    }
+  }
+}
+
 
 // sends an RPC
 func call(srv string, rpcname string, networkMode string, args interface{}, reply interface{}) bool {
@@ -52,6 +77,17 @@ func call(srv string, rpcname string, networkMode string, args interface{}, repl
 
 // get a value for the key from the pbservice
 func (ck *Clerk) Get(key string) string {
+  value, _, err := ck.GetWithVersion(key)
+  if err != OK {
+    fmt.Println("ERROR ", err)
+  }
+  return value
+}
+
+// get a value for the key and its version, to hand to ConditionalPut. the
+// version is only good with OK or ErrNoKey; ErrNoKey's is 0 for a key that
+// was never put and the tombstone's for a deleted one.
+func (ck *Clerk) GetWithVersion(key string) (string, int64, Err) {
 
   if ck.viewIsInvalid() {
     ck.updateView()
@@ -59,27 +95,22 @@ func (ck *Clerk) Get(key string) string {
 
   args := GetArgs{}
   args.Key = key
-  var reply GetReply
 
   // retry Get until succesful, updating view each attempt
   for i:=0; i < Retries; i++ {
-    shard := key2shard(args.Key)
+    shard := ck.view.ShardForKey(args.Key)
     primary, ok := ck.view.ShardsToPrimaries[shard]
     if ok {
+      var reply GetReply
       ack := call(primary, "PBServer.Get", ck.networkMode, args, &reply)
       if ack && (reply.Err == OK || reply.Err == ErrNoKey) {
-        break
+        return reply.Value, reply.Version, reply.Err
       }
     }
-    ck.updateView()
-    time.Sleep(viewservice.PING_INTERVAL)
-  }
-
-  if reply.Err != OK {
-    fmt.Println("ERROR ", reply.Err)
+    ck.awaitView()
   }
 
-  return reply.Value
+  return "", 0, ErrWrongServer
 }
 
 // put a value for the key from the pbservice
@@ -101,19 +132,320 @@ func (ck *Clerk) Put(key string, value string) {
 
   for {
 
-    shard := key2shard(args.Key)
+    shard := ck.view.ShardForKey(args.Key)
     primary, ok := ck.view.ShardsToPrimaries[shard]
 
     if ok {
       ack := call(primary, "PBServer.Put", ck.networkMode, args, &reply)
-      if ack { break }
+      if ack && reply.Err != ErrWrongServer && reply.Err != ErrNoLease { break }
     }
 
+    ck.awaitView()
+  }
+
+  if reply.Err != OK && reply.Err != ErrDuplicate {
+    fmt.Println("ERROR ", reply.Err)
+  }
+
+}
+
+// keys and values from start up to end ("" for no end), in order, and at
+// most limit of them if limit is positive. the second result is where to
+// start the next scan to get the rest, or "" if there are no more.
+func (ck *Clerk) Scan(start string, end string, limit int) ([]KeyValue, string) {
+
+  if ck.viewIsInvalid() {
     ck.updateView()
-    time.Sleep(viewservice.PING_INTERVAL)
   }
 
-  if reply.Err != OK {
+  for {
+    pairs, more, ok := ck.scanView(start, end, limit)
+    if ok {
+      sort.Slice(pairs, func(i, j int) bool {
+        return pairs[i].Key < pairs[j].Key
+      })
+      if limit > 0 && len(pairs) > limit {
+        pairs = pairs[:limit]
+        more = true
+      }
+      if more && len(pairs) > 0 {
+        return pairs, pairs[len(pairs)-1].Key + "\x00"
+      }
+      return pairs, ""
+    }
+    ck.awaitView()
+  }
+}
+
+// keys and values that start with prefix; see Scan
+func (ck *Clerk) ScanPrefix(prefix string, limit int) ([]KeyValue, string) {
+  return ck.Scan(prefix, PrefixEnd(prefix), limit)
+}
+
+// asks each primary in the clerk's view for its part of a scan. fails if
+// any of them can't answer, or a shard has no primary (e.g. while it is
+// recovered), in which case the whole scan is redone.
+func (ck *Clerk) scanView(start string, end string, limit int) ([]KeyValue, bool, bool) {
+  primaries := make(map[string][]int)
+  for _, shard := range ck.view.Shards() {
+    if ck.view.Ranges != nil {
+      r := ck.view.Ranges[shard]
+      if (r.End != "" && r.End <= start) || (end != "" && r.Start >= end) {
+        continue
+      }
+    }
+    primary, ok := ck.view.ShardsToPrimaries[shard]
+    if ! ok {
+      return nil, false, false
+    }
+    primaries[primary] = append(primaries[primary], shard)
+  }
+
+  pairs := make([]KeyValue, 0)
+  more := false
+  for primary, shards := range primaries {
+    args := ScanArgs{Shards: shards, Start: start, End: end, Limit: limit}
+    var reply ScanReply
+    ack := call(primary, "PBServer.Scan", ck.networkMode, args, &reply)
+    if ! ack || reply.Err != OK {
+      return nil, false, false
+    }
+    pairs = append(pairs, reply.Pairs...)
+    more = more || reply.More
+  }
+  return pairs, more, true
+}
+
+// put a value for the key only if the key is at version; returns the key's
+// version afterwards, and ErrVersionMismatch if it wasn't at version.
+// ErrDuplicate means the put went through, but the version it made is no
+// longer known.
+func (ck *Clerk) ConditionalPut(key string, value string, version int64) (int64, Err) {
+
+  if ck.viewIsInvalid() {
+    ck.updateView()
+  }
+
+  ck.RequestID += 1
+
+  args := ConditionalPutArgs{}
+  args.Key = key
+  args.Value = value
+  args.Version = version
+  args.Client = ck.ClientID
+  args.Request = ck.RequestID
+
+  var reply ConditionalPutReply
+
+  for {
+
+    shard := ck.view.ShardForKey(args.Key)
+    primary, ok := ck.view.ShardsToPrimaries[shard]
+
+    if ok {
+      ack := call(primary, "PBServer.ConditionalPut", ck.networkMode, args, &reply)
+      if ack && reply.Err != ErrWrongServer && reply.Err != ErrNoLease { break }
+    }
+
+    ck.awaitView()
+  }
+
+  return reply.Version, reply.Err
+}
+
+// put a batch of keys, with one RPC to each primary they belong to, one
+// after another. returns an Err for each of them; ErrDuplicate, like OK,
+// means the put went through.
+func (ck *Clerk) MultiPut(pairs []KeyValue) []Err {
+
+  if ck.viewIsInvalid() {
+    ck.updateView()
+  }
+
+  errs := make([]Err, len(pairs))
+  puts := make([]PutArgs, len(pairs))
+
+  // puts for the same primary get consecutive requests, so that they can
+  // go in one batch
+  groups := make(map[string][]int)
+  primaries := make([]string, 0)
+  for i, kv := range pairs {
+    primary := ck.view.ShardsToPrimaries[ck.view.ShardForKey(kv.Key)]
+    if _, ok := groups[primary]; ! ok {
+      primaries = append(primaries, primary)
+    }
+    groups[primary] = append(groups[primary], i)
+  }
+
+  todo := make([]int, 0)   // in the order of their requests
+  for _, primary := range primaries {
+    for _, i := range groups[primary] {
+      ck.RequestID += 1
+      puts[i] = PutArgs{Key: pairs[i].Key, Value: pairs[i].Value, Client: ck.ClientID, Request: ck.RequestID}
+      todo = append(todo, i)
+    }
+  }
+
+  // batches go out one at a time, in the order of their requests, and one
+  // that got no reply is sent again before anything after it. a primary
+  // only remembers a client's latest request, so if a later batch were
+  // logged first, the one that got lost would be taken for a duplicate
+  // once its shard moved there.
+  for len(todo) > 0 {
+
+    primary, ok := ck.view.ShardsToPrimaries[ck.view.ShardForKey(puts[todo[0]].Key)]
+    n := 0
+    for ok && n < len(todo) {
+      next := ck.view.ShardsToPrimaries[ck.view.ShardForKey(puts[todo[n]].Key)]
+      if next != primary {
+        break
+      }
+      n++
+    }
+
+    args := MultiPutArgs{Puts: make([]PutArgs, n)}
+    for j := 0; j < n; j++ {
+      args.Puts[j] = puts[todo[j]]
+    }
+    var reply MultiPutReply
+    if ! ok || ! call(primary, "PBServer.MultiPut", ck.networkMode, args, &reply) || len(reply.Errs) != n {
+      ck.awaitView()
+      continue
+    }
+
+    // what was turned away is known not to be logged; it goes again as new
+    // requests, after the rest
+    rejected := make([]int, 0)
+    for j := 0; j < n; j++ {
+      err := reply.Errs[j]
+      if err == ErrWrongServer || err == ErrNoLease {
+        rejected = append(rejected, todo[j])
+      } else {
+        errs[todo[j]] = err
+      }
+    }
+    todo = todo[n:]
+    for _, i := range rejected {
+      ck.RequestID += 1
+      puts[i].Request = ck.RequestID
+      todo = append(todo, i)
+    }
+
+    if len(rejected) > 0 {
+      ck.awaitView()
+    }
+  }
+
+  for _, err := range errs {
+    if err != OK {
+      fmt.Println("ERROR ", err)
+      break
+    }
+  }
+  return errs
+}
+// get a batch of keys, with one RPC to each primary they belong to. a key
+// that isn't there gets "" and ErrNoKey.
+func (ck *Clerk) MultiGet(keys []string) ([]string, []Err) {
+
+  if ck.viewIsInvalid() {
+    ck.updateView()
+  }
+
+  values := make([]string, len(keys))
+  errs   := make([]Err, len(keys))
+  todo   := make([]int, len(keys))
+  for i, _ := range keys {
+    todo[i] = i
+  }
+
+  for iters := 0; iters < Retries && len(todo) > 0; iters++ {
+
+    batches := make(map[string][]int)
+    for _, i := range todo {
+      primary, ok := ck.view.ShardsToPrimaries[ck.view.ShardForKey(keys[i])]
+      if ok {
+        batches[primary] = append(batches[primary], i)
+      }
+    }
+
+    var mu sync.Mutex
+    var wg sync.WaitGroup
+    done := make(map[int]bool)
+    for primary, batch := range batches {
+      wg.Add(1)
+      go func(primary string, batch []int) {
+        defer wg.Done()
+        args := MultiGetArgs{Keys: make([]string, len(batch))}
+        for j, i := range batch {
+          args.Keys[j] = keys[i]
+        }
+        var reply MultiGetReply
+        ack := call(primary, "PBServer.MultiGet", ck.networkMode, args, &reply)
+        if ! ack || len(reply.Errs) != len(batch) {
+          return
+        }
+
+        mu.Lock()
+        defer mu.Unlock()
+        for j, i := range batch {
+          if reply.Errs[j] == OK || reply.Errs[j] == ErrNoKey {
+            values[i] = reply.Values[j]
+            errs[i] = reply.Errs[j]
+            done[i] = true
+          }
+        }
+      }(primary, batch)
+    }
+    wg.Wait()
+
+    next := make([]int, 0)
+    for _, i := range todo {
+      if ! done[i] {
+        errs[i] = ErrWrongServer
+        next = append(next, i)
+      }
+    }
+    todo = next
+
+    if len(todo) > 0 {
+      ck.awaitView()
+    }
+  }
+
+  return values, errs
+}
+
+// delete the key from the pbservice, if it is there
+func (ck *Clerk) Delete(key string) {
+
+  if ck.viewIsInvalid() {
+    ck.updateView()
+  }
+
+  ck.RequestID += 1
+
+  args := DeleteArgs{}
+  args.Key = key
+  args.Client = ck.ClientID
+  args.Request = ck.RequestID
+
+  var reply DeleteReply
+
+  for {
+
+    shard := ck.view.ShardForKey(args.Key)
+    primary, ok := ck.view.ShardsToPrimaries[shard]
+
+    if ok {
+      ack := call(primary, "PBServer.Delete", ck.networkMode, args, &reply)
+      if ack && reply.Err != ErrWrongServer && reply.Err != ErrNoLease { break }
+    }
+
+    ck.awaitView()
+  }
+
+  if reply.Err != OK && reply.Err != ErrNoKey && reply.Err != ErrDuplicate {
     fmt.Println("ERROR ", reply.Err)
   }
 
@@ -129,8 +461,35 @@ func (ck *Clerk) Kill(srv string) {
 }
 
 
+// moves shard to the primary at destination (host:port)
+func (ck *Clerk) MoveShard(shard int, destination string) viewservice.Err {
+  return ck.vs.MoveShard(shard, destination)
+}
+
+
+// takes the server at srv (host:port) out of service, once its shards and
+// backups have moved elsewhere
+func (ck *Clerk) Drain(srv string) viewservice.Err {
+  return ck.vs.Drain(srv)
+}
+
+
+// splits shard in two, at key for ranges of keys; returns the new half
+func (ck *Clerk) SplitShard(shard int, key string) (int, viewservice.Err) {
+  return ck.vs.SplitShard(shard, key)
+}
+
+// merges shard back with its other half; returns the merged shard
+func (ck *Clerk) MergeShards(shard int) (int, viewservice.Err) {
+  return ck.vs.MergeShards(shard)
+}
+
+
 func (ck *Clerk) WhichShard(key string) int {
-  return key2shard(key)
+  if ck.viewIsInvalid() {
+    ck.updateView()
+  }
+  return ck.view.ShardForKey(key)
 }
 
 func (ck *Clerk) GetView() viewservice.View {
@@ -142,15 +501,28 @@ func (ck *Clerk) Status() viewservice.StatusReply {
   return ck.vs.Status()
 }
 
+func (ck *Clerk) Events(since int) []viewservice.Event {
+  return ck.vs.Events(since)
+}
+
 func (ck *Clerk) updateView() {
   view,_ := ck.vs.Get()
   ck.view = view
 }
 
-func (ck *Clerk) viewIsInvalid() bool {
-  return ck.view.ViewNumber == 0
+// picks up the next view as soon as the viewservice has one, waiting no
+// longer than a ping interval.
+func (ck *Clerk) awaitView() {
+  view, _, ok := ck.vs.WatchView(ck.view.ViewNumber, ck.vs.PingInterval())
+  if ok {
+    if view.ViewNumber >= ck.view.ViewNumber {
+      ck.view = view
+    }
+  } else {
+    time.Sleep(ck.vs.PingInterval())
+  }
 }
 
-func key2shard(key string) int {
-  return int(adler32.Checksum([]byte(key))%100)
+func (ck *Clerk) viewIsInvalid() bool {
+  return ck.view.ViewNumber == 0
 }
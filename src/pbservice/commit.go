@@ -0,0 +1,129 @@
+package pbservice
+
+
+// writes are committed in groups. each one is queued, and whoever gets
+// pb.logMu next appends everything in the queue to the log and replicates
+// it in one round, so that concurrent writes share their trip to the
+// backups. pb.mu is let go while the backups are busy, so reads, and more
+// writes joining the queue, don't wait on them.
+
+// a write waiting to be committed. the committer fills in err, and version:
+// the version the key ended up at, or for a ConditionalPut that doesn't
+// match, the version it is at.
+type write struct {
+  op Op              // its version is only known once it is committed
+  conditional bool   // only if the key is at expected
+  expected int64
+  stop *bool         // shared by the writes of a MultiPut, which stop at the first one turned away
+
+  err Err
+  version int64
+}
+
+
+// queues ws and waits until they are committed, by us or by whoever was
+// committing when they came in. callers must not hold pb.mu.
+func (pb *PBServer) submit(ws ...*write) {
+  pb.mu.Lock()
+  pb.queue = append(pb.queue, ws...)
+  pb.mu.Unlock()
+
+  pb.commitQueued()
+}
+
+
+// commits everything in the queue, if anything is left by the time we
+// get pb.logMu.
+func (pb *PBServer) commitQueued() {
+  pb.logMu.Lock()
+  defer pb.logMu.Unlock()
+  pb.mu.Lock()
+  defer pb.mu.Unlock()
+
+  queued := pb.queue
+  pb.queue = nil
+
+  ops    := make([]Op, 0)
+  writes := make([]*write, 0)      // the write each op is for
+  shards := make([]int, 0)
+  latest := make(map[string]Op)    // ops in this group, over those in the store
+
+  // retries of a request still in the queue get its result
+  type request struct { client, request int64 }
+  first := make(map[request]*write)
+  repeats := make(map[*write]*write)
+
+  for _, w := range queued {
+    shard := pb.view.ShardForKey(w.op.Key)
+    turnedAway := Err("")
+    if (w.stop != nil && *w.stop) || ! pb.servesShard(shard) {
+      turnedAway = ErrWrongServer
+    } else if ! pb.leaseValid() {
+      turnedAway = ErrNoLease
+    }
+    if turnedAway != "" {
+      if w.stop != nil {
+        *w.stop = true
+      }
+      w.err = turnedAway
+      continue
+    }
+
+    if version, err, ok := pb.loggedRequest(w.op.Client, w.op.Request, w.op.Key); ok {
+      w.version = version
+      w.err = err
+      continue
+    }
+    if w.op.Client != 0 {
+      req := request{w.op.Client, w.op.Request}
+      if earlier, ok := first[req]; ok {
+        repeats[w] = earlier
+        continue
+      }
+      first[req] = w
+    }
+
+    cur, ok := latest[w.op.Key]
+    if ! ok {
+      if op, ok := pb.store[w.op.Key]; ok {
+        cur = *op
+      }
+    }
+
+    if w.op.Type == DeleteOp && (cur.Version == 0 || cur.Type == DeleteOp) {
+      w.err = ErrNoKey
+      continue
+    }
+    if w.conditional && cur.Version != w.expected {
+      w.version = cur.Version
+      w.err = ErrVersionMismatch
+      continue
+    }
+
+    op := w.op
+    op.Version = cur.Version + 1
+    latest[op.Key] = op
+
+    ops    = append(ops, op)
+    writes = append(writes, w)
+    shards = append(shards, shard)
+  }
+
+  n, err := pb.replicateBatch(ops)
+
+  for j, w := range writes {
+    if j < n {
+      pb.storeOp(&ops[j])
+      pb.markDirty(shards[j], ops[j].Key)
+      w.version = ops[j].Version
+      w.err = OK
+    } else {
+      w.err = err
+    }
+  }
+
+  for w, earlier := range repeats {
+    w.version = earlier.version
+    w.err = earlier.err
+  }
+}
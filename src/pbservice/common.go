@@ -1,5 +1,10 @@
 package pbservice
 
+import (
+  "time"
+  "viewservice"
+)
+
 const (
 
   OK = "OK"
@@ -16,6 +21,22 @@ const (
 
   ErrNotPending = "ErrNotPending"
 
+  ErrMigrationFailed = "ErrMigrationFailed"
+
+  ErrStaleIncarnation = "ErrStaleIncarnation"
+
+  ErrRetiring = "ErrRetiring"
+
+  ErrNotDraining = "ErrNotDraining"
+
+  ErrNoLease = "ErrNoLease"
+
+  ErrFenced = "ErrFenced"
+
+  ErrVersionMismatch = "ErrVersionMismatch"
+
+  ErrDuplicate = "ErrDuplicate"
+
 )
 
 type Err string
@@ -39,6 +60,18 @@ type PutReply struct {
   Err Err
 }
 
+// Delete
+
+type DeleteArgs struct {
+  Key string
+  Client int64
+  Request int64
+}
+
+type DeleteReply struct {
+  Err Err
+}
+
 // Get
 
 type GetArgs struct {
@@ -50,6 +83,64 @@ type GetArgs struct {
 type GetReply struct {
   Err Err
   Value string
+  Version int64     // 0 if the key was never put
+}
+
+// MultiPut
+
+type MultiPutArgs struct {
+  Puts []PutArgs    // in the order of their requests
+}
+
+type MultiPutReply struct {
+  Errs []Err        // one for each put
+}
+
+// MultiGet
+
+type MultiGetArgs struct {
+  Keys []string
+}
+
+type MultiGetReply struct {
+  Values []string   // one for each key
+  Errs []Err
+}
+
+// ConditionalPut
+
+type ConditionalPutArgs struct {
+  Key string
+  Value string
+  Version int64     // the version the key must be at
+  Client int64
+  Request int64
+}
+
+type ConditionalPutReply struct {
+  Err Err
+  Version int64     // the key's version now
+}
+
+
+// Scan
+
+type ScanArgs struct {
+  Shards []int      // the shards of the primary to scan
+  Start string
+  End string        // "" for no end
+  Limit int         // at most this many; no limit if 0
+}
+
+type ScanReply struct {
+  Err Err
+  Pairs []KeyValue  // in order of their keys
+  More bool         // whether Limit cut the scan short
+}
+
+type KeyValue struct {
+  Key string
+  Value string
 }
 
 
@@ -57,7 +148,9 @@ type GetReply struct {
 
 type ForwardOpArgs struct {
   Origin string
-  Op Op
+  Incarnation int64
+  ViewNumber uint     // origin's view when it sent this
+  Ops []Op            // in the order they were appended
   Segment int64
 }
 
@@ -70,6 +163,8 @@ type ForwardOpReply struct {
 
 type FlushSegArgs struct {
   Origin string
+  Incarnation int64
+  ViewNumber uint
   OldSegment int64
 }
 
@@ -81,6 +176,8 @@ type FlushSegReply struct {
 
 type EnlistReplicaArgs struct {
   Origin string
+  Incarnation int64
+  ViewNumber uint
   Segment Segment
 }
 
@@ -104,7 +201,7 @@ type PullSegmentsReply struct {
 
 type PullSegmentsByShardsArgs struct {
   Owner string
-  Shards map[int] bool
+  Partitions map[int]viewservice.Partition     // ops for keys in these are wanted
   Segments []int64
 }
 
@@ -117,11 +214,14 @@ type PullSegmentsByShardsReply struct {
 
 type QuerySegmentsArgs struct {
   DeadPrimaries map[string][]int
+  Incarnations map[string]int64    // which incarnation of each dead primary died
+  ViewNumber uint     // the view the dead primaries were taken out of
 }
 
 type QuerySegmentsReply struct {
   ServerName string
   BackedUpSegments map[string]map[int64]map[int]bool
+  Digests map[string][]int64     // dead primary -> ids of its newest segment and all before it
 }
 
 
@@ -130,6 +230,7 @@ type QuerySegmentsReply struct {
 type ElectRecoveryMasterArgs struct {
   RecoveryData map[int]map[int64][]string
   DeadPrimaries map[string][]int
+  Partitions map[int]viewservice.Partition     // keys each shard being recovered holds
 }
 
 type ElectRecoveryMasterReply struct {
@@ -138,6 +239,71 @@ type ElectRecoveryMasterReply struct {
 }
 
 
+// MigrateShard
+
+type MigrateShardArgs struct {
+  Shard int
+  Destination string
+}
+
+type MigrateShardReply struct {
+  Err Err
+  OpsSent int
+  BeforeFreeze time.Duration   // from when the request came in until the shard was frozen
+}
+
+
+// ReceiveShard
+
+type ReceiveShardArgs struct {
+  Origin string
+  Shard int
+  Ops []Op
+  Requests []Op    // latest request of clients that last wrote to the shard, without values
+}
+
+type ReceiveShardReply struct {
+  Err Err
+}
+
+
+// HandoffBackups
+
+type HandoffBackupsArgs struct {
+}
+
+type HandoffBackupsReply struct {
+  Err Err
+  Unreplaced []string     // origins some of whose segments nobody else took
+}
+
+
+// ReplaceBackup
+
+type ReplaceBackupArgs struct {
+  Backup string      // server giving up its copies
+  Segments []int64
+}
+
+type ReplaceBackupReply struct {
+  Err Err
+}
+
+
+// StoreSegment
+
+type StoreSegmentArgs struct {
+  Origin string
+  Incarnation int64
+  ViewNumber uint
+  Segment Segment
+}
+
+type StoreSegmentReply struct {
+  Err Err
+}
+
+
 type KillArgs struct {
 
 }
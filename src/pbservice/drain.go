@@ -0,0 +1,198 @@
+package pbservice
+
+import (
+  "fmt"
+  "time"
+)
+
+
+// passes every segment we back up on to another backup, chosen by the
+// segment's primary. runs on a server being drained, once it is no longer
+// primary for anything; afterwards it takes no new backups. segments whose
+// primary is dead, or an older incarnation, can't be passed on; their
+// origins are listed in the reply, so that the viewservice can keep us
+// around while they are being recovered. if the handoff fails we take
+// backups again until the viewservice retries it.
+func (pb *PBServer) HandoffBackups(args *HandoffBackupsArgs, reply *HandoffBackupsReply) error {
+
+  // only once the viewservice has told us we're being drained
+  pb.mu.Lock()
+  draining := pb.draining[pb.me]
+  pb.mu.Unlock()
+  if ! draining {
+    reply.Err = ErrNotDraining
+    return nil
+  }
+
+  pb.backupMu.Lock()
+  pb.retiring = true
+  segments   := make(map[string][]int64)
+  unreplaced := make(map[string]bool)
+  for origin, segs := range pb.backedUpSegs {
+    for seg, _ := range segs {
+      if pb.segIncarnations[seg] == pb.incarnations[origin] {
+        segments[origin] = append(segments[origin], seg)
+      } else {
+        unreplaced[origin] = true
+      }
+    }
+  }
+  pb.backupMu.Unlock()
+
+  for origin, segs := range segments {
+
+    pb.mu.Lock()
+    alive := pb.serversAlive[origin]
+    pb.mu.Unlock()
+    if ! alive {
+      unreplaced[origin] = true
+      continue
+    }
+
+    replaceArgs := &ReplaceBackupArgs{Backup: pb.me, Segments: segs}
+
+    replaced := false
+    for i := 0; i < pb.config.Retries && ! replaced; i++ {
+      replaceReply := new(ReplaceBackupReply)
+      ok := call(origin, "PBServer.ReplaceBackup", pb.networkMode, replaceArgs, replaceReply)
+      if ok && replaceReply.Err == OK {
+        replaced = true
+      } else {
+        time.Sleep(10 * time.Millisecond)
+      }
+    }
+
+    if ! replaced {
+      fmt.Printf("%s couldn't replace us as a backup\n", origin)
+      pb.backupMu.Lock()
+      pb.retiring = false
+      pb.backupMu.Unlock()
+      reply.Err = ErrBackupFailure
+      return nil
+    }
+  }
+
+  for origin, _ := range unreplaced {
+    reply.Unreplaced = append(reply.Unreplaced, origin)
+  }
+  reply.Err = OK
+  return nil
+}
+
+
+// finds a new backup for each of args.Segments, in place of args.Backup,
+// and copies the segment over. runs on the segments' primary.
+func (pb *PBServer) ReplaceBackup(args *ReplaceBackupArgs, reply *ReplaceBackupReply) error {
+  pb.logMu.Lock()
+  defer pb.logMu.Unlock()
+  pb.mu.Lock()
+  defer pb.mu.Unlock()
+
+  for _, segID := range args.Segments {
+
+    group, ok := pb.backups[segID]
+    seg, segok := pb.log.Segments[segID]
+    if ! ok || ! segok {
+      continue
+    }
+
+    remaining := make([]string, 0)
+    exclude   := map[string]bool{pb.me: true, args.Backup: true}
+    for _, backup := range group.Backups {
+      exclude[backup] = true
+      if backup != args.Backup {
+        remaining = append(remaining, backup)
+      }
+    }
+
+    if len(remaining) == len(group.Backups) {
+      // already replaced
+      continue
+    }
+
+    replacement, ok := pb.pickBackup(exclude)
+    if ! ok {
+      fmt.Println("no server to take over backup of ", segID)
+      reply.Err = ErrBackupFailure
+      return nil
+    }
+
+    // the segment we're writing to gets enlisted like any other, so that
+    // the new backup keeps up with forwarded ops; the rest are stored as is
+    var err Err
+    var ack bool
+    if segID == pb.log.CurrSegID {
+      enlistArgs := &EnlistReplicaArgs{Origin: pb.me, Incarnation: pb.incarnation, ViewNumber: pb.view.ViewNumber, Segment: *seg}
+      enlistReply := new(EnlistReplicaReply)
+      ack = call(replacement, "PBServer.EnlistReplica", pb.networkMode, enlistArgs, enlistReply)
+      err = enlistReply.Err
+    } else {
+      storeArgs := &StoreSegmentArgs{Origin: pb.me, Incarnation: pb.incarnation, ViewNumber: pb.view.ViewNumber, Segment: *seg}
+      storeReply := new(StoreSegmentReply)
+      ack = call(replacement, "PBServer.StoreSegment", pb.networkMode, storeArgs, storeReply)
+      err = storeReply.Err
+    }
+
+    if ! ack || err != OK {
+      fmt.Println("couldn't hand segment to ", replacement, err)
+      reply.Err = ErrBackupFailure
+      return nil
+    }
+
+    group.Backups = append(remaining, replacement)
+    pb.backups[segID] = group
+  }
+
+  reply.Err = OK
+  return nil
+}
+
+
+// a live server that isn't being drained and isn't in exclude, picked at
+// random, preferably from a failure domain none of exclude is in. callers
+// must hold pb.mu.
+func (pb *PBServer) pickBackup(exclude map[string]bool) (string, bool) {
+  available := make(map[string]bool)
+  for srv, alive := range pb.serversAlive {
+    if alive && ! pb.draining[srv] && ! exclude[srv] {
+      available[srv] = true
+    }
+  }
+
+  candidates := pb.spreadOverDomains(available, exclude)
+  if len(candidates) == 0 {
+    return "", false
+  }
+  return candidates[0], true
+}
+
+
+// takes over the backup of a segment that origin has already flushed.
+func (pb *PBServer) StoreSegment(args *StoreSegmentArgs, reply *StoreSegmentReply) error {
+  pb.backupMu.Lock()
+  defer pb.backupMu.Unlock()
+
+  if pb.retiring {
+    reply.Err = ErrRetiring
+    return nil
+  }
+
+  err := pb.noteIncarnation(args.Origin, args.Incarnation)
+  if err == OK {
+    err = pb.checkPrimary(args.Origin, args.ViewNumber, 0)
+  }
+  if err != OK {
+    reply.Err = err
+    return nil
+  }
+
+  _, stored := pb.backedUpSegs[args.Origin][args.Segment.ID]
+  if ! stored {
+    pb.recordSegment(args.Origin, args.Incarnation, args.Segment)
+    pb.persisting[args.Segment.ID] = &args.Segment
+    go pb.persistSegment(args.Origin, args.Segment)
+  }
+
+  reply.Err = OK
+  return nil
+}
@@ -0,0 +1,244 @@
+package pbservice
+
+import (
+  "fmt"
+  "time"
+  "viewservice"
+)
+
+
+// how long a primary holds a shard frozen, waiting for the viewservice to
+// hand it to its new owner, before going back to serving it.
+const FreezeTimeout = 2 * viewservice.HANDOFF_TIMEOUT
+
+
+// hands shard off to args.Destination. runs on the shard's current primary at
+// the viewservice's request, for rebalancing or an operator's MoveShard; once
+// this returns OK the shard stays frozen here until the view moves it.
+func (pb *PBServer) MigrateShard(args *MigrateShardArgs, reply *MigrateShardReply) error {
+  arrived := time.Now()
+
+  pb.mu.Lock()
+  _, inProcess := pb.migrating[args.Shard]
+  if ! pb.servesShard(args.Shard) || inProcess {
+    pb.mu.Unlock()
+    reply.Err = ErrWrongServer
+    return nil
+  }
+
+  // keep track of keys written while the bulk of the shard is in flight
+  pb.migrating[args.Shard] = make(map[string]bool)
+  ops := pb.shardOps(args.Shard, nil)
+  pb.mu.Unlock()
+
+  sent := len(ops)
+  err  := pb.sendShard(args.Destination, args.Shard, ops, nil)
+
+  // writes being committed are let through first, so that they are among
+  // the dirty keys
+  pb.logMu.Lock()
+  pb.mu.Lock()
+  dirty := pb.migrating[args.Shard]
+  delete(pb.migrating, args.Shard)
+
+  if err != OK {
+    pb.mu.Unlock()
+    pb.logMu.Unlock()
+    reply.Err = err
+    return nil
+  }
+
+  // stop taking writes, then send whatever changed in the meantime, and
+  // which requests are in, so that retries aren't applied twice
+  pb.frozen[args.Shard] = time.Now()
+  reply.BeforeFreeze = time.Since(arrived)
+  ops = pb.shardOps(args.Shard, dirty)
+  requests := pb.shardRequests(args.Shard)
+  pb.mu.Unlock()
+  pb.logMu.Unlock()
+
+  err = pb.sendShard(args.Destination, args.Shard, ops, requests)
+  if err != OK {
+    pb.mu.Lock()
+    delete(pb.frozen, args.Shard)
+    pb.mu.Unlock()
+    reply.Err = err
+    return nil
+  }
+
+  reply.OpsSent = sent + len(ops)
+  reply.Err = OK
+  return nil
+}
+
+
+// takes over ops for a shard that is being handed to us, replicating them to
+// our own backups. runs on the shard's new primary. a chunk goes to the
+// backups in one batch, and none of it is stored unless all of it made it;
+// the sender tries again, or keeps the shard.
+func (pb *PBServer) ReceiveShard(args *ReceiveShardArgs, reply *ReceiveShardReply) error {
+  pb.logMu.Lock()
+  defer pb.logMu.Unlock()
+  pb.mu.Lock()
+  defer pb.mu.Unlock()
+
+  ops := make([]Op, 0)
+  for _, newOp := range args.Ops {
+
+    op := newOp
+
+    currOp, ok := pb.store[op.Key]
+    if ok && currOp.Version >= op.Version {
+      pb.noteRequest(&op)
+      continue
+    }
+    ops = append(ops, op)
+  }
+
+  // pb.mu is let go while the backups are busy
+  _, err := pb.replicateBatch(ops)
+  if err != OK {
+    reply.Err = err
+    return nil
+  }
+
+  for i, _ := range ops {
+    currOp, ok := pb.store[ops[i].Key]
+    if ! ok || currOp.Version < ops[i].Version {
+      pb.storeOp(&ops[i])
+    }
+  }
+
+  for _, newOp := range args.Requests {
+    op := newOp
+    pb.noteRequest(&op)
+  }
+
+  reply.Err = OK
+  return nil
+}
+
+
+// latest ops for the keys of shard. if keys is non-nil, only those keys are
+// included. callers must hold pb.mu.
+func (pb *PBServer) shardOps(shard int, keys map[string]bool) []Op {
+  ops := make([]Op, 0)
+
+  if keys != nil {
+    for key, _ := range keys {
+      op, ok := pb.store[key]
+      if ok {
+        ops = append(ops, *op)
+      }
+    }
+    return ops
+  }
+
+  // filtered the same way as segments pulled during recovery
+  partitions := map[int]viewservice.Partition{shard: pb.view.PartitionOf(shard)}
+  for _, op := range pb.store {
+    if opInPartitions(*op, partitions) {
+      ops = append(ops, *op)
+    }
+  }
+  return ops
+}
+
+
+// the latest request of each client whose last write was to shard, without
+// its value. a client only sends a request once those before it are done,
+// so earlier ones can't come again. callers must hold pb.mu.
+func (pb *PBServer) shardRequests(shard int) []Op {
+  requests := make([]Op, 0)
+  partitions := map[int]viewservice.Partition{shard: pb.view.PartitionOf(shard)}
+  for _, op := range pb.requests {
+    if opInPartitions(*op, partitions) {
+      request := *op
+      request.Value = ""
+      requests = append(requests, request)
+    }
+  }
+  return requests
+}
+
+
+// max number of bytes of ops sent in a single ReceiveShard call
+func (pb *PBServer) transferLimit() int {
+  return pb.config.SegLimit / 2
+}
+
+// ships ops to the new primary in chunks; requests go with the first
+func (pb *PBServer) sendShard(dest string, shard int, ops []Op, requests []Op) Err {
+
+  for start := 0; start < len(ops) || len(requests) > 0; {
+
+    // fill up a chunk
+    end  := start
+    size := 0
+    for end < len(ops) && (end == start || size + ops[end].size() <= pb.transferLimit()) {
+      size += ops[end].size()
+      end++
+    }
+
+    args := new(ReceiveShardArgs)
+    args.Origin = pb.me
+    args.Shard  = shard
+    args.Ops    = ops[start:end]
+    args.Requests = requests
+    requests = nil
+
+    sent := false
+    for i := 0; i < pb.config.Retries && ! sent; i++ {
+      reply := new(ReceiveShardReply)
+      ok := call(dest, "PBServer.ReceiveShard", pb.networkMode, args, reply)
+      if ok && reply.Err == OK {
+        sent = true
+      } else if ok {
+        fmt.Println("ERROR ", reply.Err)
+        return reply.Err
+      } else {
+        time.Sleep(10 * time.Millisecond)
+      }
+    }
+
+    if ! sent {
+      return ErrMigrationFailed
+    }
+
+    start = end
+  }
+
+  return OK
+}
+
+
+// records that key was written while its shard is being handed off.
+// callers must hold pb.mu.
+func (pb *PBServer) markDirty(shard int, key string) {
+  dirty, ok := pb.migrating[shard]
+  if ok {
+    dirty[key] = true
+  }
+}
+
+
+// lets go of frozen shards, either because the view has moved them (and we
+// can forget their data) or because the viewservice never did.
+// callers must hold pb.mu.
+func (pb *PBServer) releaseFrozen() {
+  for shard, since := range pb.frozen {
+
+    if pb.view.ShardsToPrimaries[shard] != pb.me {
+      for key, _ := range pb.store {
+        if pb.view.ShardForKey(key) == shard {
+          pb.dropKey(key)
+        }
+      }
+      delete(pb.frozen, shard)
+
+    } else if time.Since(since) >= FreezeTimeout {
+      fmt.Printf("Handoff of shard %d timed out; serving it again.\n", shard)
+      delete(pb.frozen, shard)
+    }
+  }
+}
@@ -0,0 +1,89 @@
+package pbservice
+
+import (
+  "sort"
+)
+
+
+// the keys of the store, in order, so that they can be scanned. kept as a
+// sorted slice: new keys cost a copy, but scans are just a walk.
+type keyIndex struct {
+  keys []string
+}
+
+// where key is, or would go
+func (ix *keyIndex) seek(key string) int {
+  return sort.SearchStrings(ix.keys, key)
+}
+
+func (ix *keyIndex) insert(key string) {
+  i := ix.seek(key)
+  if i < len(ix.keys) && ix.keys[i] == key {
+    return
+  }
+  ix.keys = append(ix.keys, "")
+  copy(ix.keys[i+1:], ix.keys[i:])
+  ix.keys[i] = key
+}
+
+func (ix *keyIndex) remove(key string) {
+  i := ix.seek(key)
+  if i < len(ix.keys) && ix.keys[i] == key {
+    ix.keys = append(ix.keys[:i], ix.keys[i+1:]...)
+  }
+}
+
+
+// the first key after every key that starts with prefix, or "" if there is
+// no such key
+func PrefixEnd(prefix string) string {
+  b := []byte(prefix)
+  for len(b) > 0 && b[len(b)-1] == 0xff {
+    b = b[:len(b)-1]
+  }
+  if len(b) == 0 {
+    return ""
+  }
+  b[len(b)-1]++
+  return string(b)
+}
+
+
+// keys and values in args.Shards from args.Start up to args.End, in order.
+// stops after args.Limit of them, if it is positive.
+func (pb *PBServer) Scan(args *ScanArgs, reply *ScanReply) error {
+  pb.mu.Lock()
+  defer pb.mu.Unlock()
+
+  shards := make(map[int]bool)
+  for _, shard := range args.Shards {
+    if ! pb.servesShard(shard) {
+      reply.Err = ErrWrongServer
+      return nil
+    }
+    shards[shard] = true
+  }
+  if ! pb.leaseValid() {
+    reply.Err = ErrNoLease
+    return nil
+  }
+
+  reply.Pairs = make([]KeyValue, 0)
+  for i := pb.index.seek(args.Start); i < len(pb.index.keys); i++ {
+    key := pb.index.keys[i]
+    if args.End != "" && key >= args.End {
+      break
+    }
+    if ! shards[pb.view.ShardForKey(key)] || pb.store[key].Type == DeleteOp {
+      continue
+    }
+    if args.Limit > 0 && len(reply.Pairs) == args.Limit {
+      reply.More = true
+      break
+    }
+    reply.Pairs = append(reply.Pairs, KeyValue{Key: key, Value: pb.store[key].Value})
+  }
+
+  reply.Err = OK
+  return nil
+}
@@ -26,20 +26,9 @@ import (
 const (
   GetOp = iota
   PutOp
+  DeleteOp
 )
 
-// max number of bytes allowed for a segment.
-const SegLimit = 8 * 1024 * 1024
-
-// replication level for cluster
-const RepLevel = 2
-
-// number of times to retry
-const Retries = 5
-
-// absolute path where log segments should be stored
-const SegPath = "/tmp/segment/"
-
 
 type PBServer struct {
   mu sync.Mutex
@@ -48,56 +37,92 @@ type PBServer struct {
   unreliable bool // for testing
   me string
   meHash string
+  incarnation int64    // tells this run of the server apart from earlier ones
+  capacity int64       // memory we have for the store, as far as placement goes
+  config viewservice.Config
 
   // TODO: reference to shardmaster
   clerk *viewservice.Clerk
 
   view viewservice.View
+  leaseExpiry time.Time   // we may only serve our shards until then
   //Config shardmaster.Config
 
   log *Log
 
+  // held by whoever is appending to the log and replicating it, which is
+  // done in groups of writes from the queue; taken before pb.mu
+  logMu sync.Mutex
+  queue []*write
+
   // pointers to PUTs live here.
   store map[string]*Op
+  storeBytes int64
+  index keyIndex     // keys of the store, in order
 
   // backup buffers: map each server to a Segment.
   backupMu sync.Mutex
   buffers map[string]*Segment
+  persisting map[int64]*Segment  // flushed, but maybe not on disk yet
 
   // which segs am I responsible for?
   backedUpSegs map[string]map[int64]map[int]bool
 
+  // set once we start handing our backups off to other servers; from then
+  // on we don't take any new ones
+  retiring bool
+
+  // latest incarnation of each origin, and which one wrote each segment
+  incarnations map[string]int64
+  segIncarnations map[int64]int64
+
+  // view in which each origin was deposed; what it sent in earlier views
+  // might be for shards that are being recovered elsewhere
+  fences map[string]uint
+
+  // ids of every segment in each origin incarnation's log, up to the newest
+  // one we back up
+  digests map[string]map[int64][]int64
+
   // primary's backup map
   backups map[int64]BackupGroup
 
   // which segments have we already banished to disk
   flushed map[int64]bool
 
-  // have we seen these puts?
-  request map[Request]bool
+  // latest request of each client that is in the log, as the op it was
+  // logged as. clerks wait for one request before sending the next, so
+  // anything up to it is a retry.
+  requests map[int64]*Op
 
   // who's around?
   serversAlive map[string]bool
+  draining map[string]bool     // alive, but not to be picked as backups
+  domains map[string]string    // failure domains, so backups don't all share one
 
-  networkMode string
+  // shards being handed off to another primary: keys written since the
+  // handoff started, and when we stopped accepting writes.
+  migrating map[int]map[string]bool
+  frozen map[int]time.Time
 
-}
+  // load for pings to report, worked out in the background so that a ping
+  // never waits on pb.mu or pb.backupMu, which replication and recovery
+  // may hold for a long time
+  loadMu sync.Mutex
+  lastLoad viewservice.ServerLoad
+  refreshing bool
 
-// REQUEST
+  networkMode string
 
-type Request struct {
-  Client int64
-  Request int64
 }
 
-
 // OPERATION
 
 type Op struct {
   Version int64
   Client int64
   Request int64
-  Type int // {GetOp, PutOp}
+  Type int // {GetOp, PutOp, DeleteOp}
   Key string
   Value string
 }
@@ -113,6 +138,16 @@ func (op Op) Equals (diffOp Op) bool {
   return reflect.DeepEqual(op, diffOp)
 }
 
+// does op belong to one of partitions?
+func opInPartitions(op Op, partitions map[int]viewservice.Partition) bool {
+  for _, partition := range partitions {
+    if partition.Holds(op.Key) {
+      return true
+    }
+  }
+  return false
+}
+
 // LOG
 
 type Log struct {
@@ -121,13 +156,14 @@ type Log struct {
   CurrOpID int64
 }
 
-func (l *Log) init() {
+func (l *Log) init(segLimit int) {
   l.Segments = make(map[int64]*Segment)
 
   l.CurrOpID = int64(0)
 
   seg := new(Segment)
   seg.Size = 0
+  seg.Limit = segLimit
   seg.Active = true
   seg.ID = rand.Int63()
   seg.Digest = make([]int64, 0)
@@ -146,6 +182,7 @@ func (l *Log) newSegment() *Segment {
 
   seg := new(Segment)
   seg.Size = 0
+  seg.Limit = prevSegment.Limit
   seg.Active = true
   seg.ID = rand.Int63()
   seg.Ops = make([]Op, 0)
@@ -164,13 +201,14 @@ type Segment struct {
   ID int64
   Active bool
   Size int  //in bytes
+  Limit int  //max size in bytes
   Digest []int64  //the ids of all preceding segments in log
   Ops []Op
 }
 
 func (s *Segment) append (op Op) bool {
   opSize := op.size()
-  if s.Size + opSize > SegLimit {
+  if s.Size + opSize > s.Limit {
     return false
   }
   s.Ops = append(s.Ops, op)
@@ -228,7 +266,8 @@ func (pb *PBServer) recordShardBackup (origin string, segID int64, op Op) {
     pb.backedUpSegs[origin][segID] = make(map[int]bool)
   }
 
-  pb.backedUpSegs[origin][segID][key2shard(op.Key)] = true
+  // by the shard the key was in before any splits, which stays put
+  pb.backedUpSegs[origin][segID][viewservice.BaseShard(op.Key, pb.config.NumberOfShards)] = true
 
 }
 
@@ -240,7 +279,7 @@ func (pb *PBServer) PullSegments(args *PullSegmentsArgs, reply *PullSegmentsRepl
     go func(i int, segId int64) {
       segment := Segment{}
       fname := strconv.Itoa(int(segId))
-      segment.slurp(path.Join(SegPath, fname))
+      segment.slurp(path.Join(pb.config.SegPath, fname))
       segments[i] = segment
       wg.Done()
     }(i, segId)
@@ -255,15 +294,22 @@ func (pb *PBServer) Get(args *GetArgs, reply *GetReply) error {
   pb.mu.Lock()
   defer pb.mu.Unlock()
 
-  shard := key2shard(args.Key)
-  if pb.view.ShardsToPrimaries[shard] != pb.me {
+  shard := pb.view.ShardForKey(args.Key)
+  if ! pb.servesShard(shard) {
     reply.Err = ErrWrongServer
     return nil
   }
+  if ! pb.leaseValid() {
+    reply.Err = ErrNoLease
+    return nil
+  }
 
   op, ok := pb.store[args.Key]
 
-  if ! ok {
+  if ok {
+    reply.Version = op.Version
+  }
+  if ! ok || op.Type == DeleteOp {
     reply.Err = ErrNoKey
     return nil
   }
@@ -274,15 +320,139 @@ func (pb *PBServer) Get(args *GetArgs, reply *GetReply) error {
 }
 
 func (pb *PBServer) Put(args *PutArgs, reply *PutReply) error {
-  pb.mu.Lock()
-  defer pb.mu.Unlock()
+  w := &write{}
+  w.op = Op{Client: args.Client, Request: args.Request, Type: PutOp, Key: args.Key, Value: args.Value}
+
+  pb.submit(w)
 
-  shard := key2shard(args.Key)
+  reply.Err = w.err
+  return nil
+}
+
+// puts the value only if the key is still at args.Version: 0 if it was
+// never put, or the version of its tombstone if it was deleted. versions
+// are part of the ops in the log, so they carry over to whoever recovers
+// or takes over the key.
+func (pb *PBServer) ConditionalPut(args *ConditionalPutArgs, reply *ConditionalPutReply) error {
+  w := &write{conditional: true, expected: args.Version}
+  w.op = Op{Client: args.Client, Request: args.Request, Type: PutOp, Key: args.Key, Value: args.Value}
+
+  pb.submit(w)
+
+  reply.Version = w.version
+  reply.Err = w.err
+  return nil
+}
+
+// logs a tombstone for the key. the tombstone stays in the store in place
+// of the key's value, so that the key's versions keep going up and replaying
+// older puts during recovery can't bring the key back.
+func (pb *PBServer) Delete(args *DeleteArgs, reply *DeleteReply) error {
+  w := &write{}
+  w.op = Op{Client: args.Client, Request: args.Request, Type: DeleteOp, Key: args.Key}
+
+  pb.submit(w)
+
+  reply.Err = w.err
+  return nil
+}
+
+// puts op in the store, keeping track of how much memory the store uses.
+// callers must hold pb.mu.
+func (pb *PBServer) storeOp(op *Op) {
+  oldOp, ok := pb.store[op.Key]
+  if ok {
+    pb.storeBytes -= int64(oldOp.size())
+  } else {
+    pb.index.insert(op.Key)
+  }
+  pb.store[op.Key] = op
+  pb.storeBytes += int64(op.size())
+  pb.noteRequest(op)
+}
+
+// whether a client's request for key was logged, and if so what to answer
+// it with: OK and the version it was logged at, if we still know it, or
+// ErrDuplicate if it has been overwritten since and the client has moved on
+// to later requests. callers must hold pb.mu.
+func (pb *PBServer) loggedRequest(client int64, request int64, key string) (int64, Err, bool) {
+  if client == 0 {
+    return 0, "", false
+  }
+  latest, ok := pb.requests[client]
+  if ! ok || latest.Request < request {
+    return 0, "", false
+  }
+  if latest.Request == request && latest.Key == key {
+    return latest.Version, OK, true
+  }
+  op, ok := pb.store[key]
+  if ok && op.Client == client && op.Request == request {
+    return op.Version, OK, true
+  }
+  return 0, ErrDuplicate, true
+}
+
+// remembers that op's request is in the log, whether or not op is still the
+// latest for its key. callers must hold pb.mu.
+func (pb *PBServer) noteRequest(op *Op) {
+  if op.Client == 0 {
+    return
+  }
+  latest, ok := pb.requests[op.Client]
+  if ! ok || latest.Request < op.Request {
+    pb.requests[op.Client] = op
+  }
+}
+
+// forgets key. callers must hold pb.mu.
+func (pb *PBServer) dropKey(key string) {
+  oldOp, ok := pb.store[key]
+  if ok {
+    pb.storeBytes -= int64(oldOp.size())
+    delete(pb.store, key)
+    pb.index.remove(key)
+  }
+}
+
+// is this server currently the one to talk to about shard?
+// callers must hold pb.mu.
+func (pb *PBServer) servesShard(shard int) bool {
   if pb.view.ShardsToPrimaries[shard] != pb.me {
-    reply.Err = ErrWrongServer
-    return nil
+    return false
+  }
+  _, frozen := pb.frozen[shard]
+  return ! frozen
+}
+
+// whether the viewservice still vouches for us as a primary. once the lease
+// runs out, our shards may already be recovering somewhere else. callers
+// must hold pb.mu.
+func (pb *PBServer) leaseValid() bool {
+  return time.Now().Before(pb.leaseExpiry)
+}
+
+// appends op to the log and forwards it to the backups of the current
+// segment. callers must hold pb.logMu and pb.mu.
+func (pb *PBServer) replicate(op Op) Err {
+  _, err := pb.replicateBatch([]Op{op})
+  return err
+}
+
+// appends ops to the log and forwards them to the backups in as few rounds
+// as the segments allow: one, unless a segment fills up. returns how many
+// of them, from the first, the backups have. callers must hold pb.logMu
+// and pb.mu; pb.mu is let go while the backups are busy, so the store may
+// change in the meantime, but not the log.
+func (pb *PBServer) replicateBatch(ops []Op) (int, Err) {
+  if len(ops) == 0 {
+    return 0, OK
   }
 
+  // the view the batch was accepted in, which backups check it against
+  // even once we've let go of pb.mu
+  viewNumber := pb.view.ViewNumber
+
   seg, _ := pb.log.getCurrSegment()
 
   group, ok := pb.backups[seg.ID]
@@ -300,83 +470,80 @@ func (pb *PBServer) Put(args *PutArgs, reply *PutReply) error {
   if ! ok {
     if pb.enlistReplicas(*seg) == false {
       fmt.Println("couldn't enlist enough replicas")
-      reply.Err = ErrBackupFailure
-      return nil
+      return 0, ErrBackupFailure
     } else {
       group = pb.backups[seg.ID]
     }
   }
 
-  oldOp, ok := pb.store[args.Key]
+  done    := 0   // ops the backups have
+  pending := 0   // ops after those, appended to seg but not forwarded yet
 
-  // create operation
-  putOp := new(Op)
-  putOp.Client = args.Client
-  putOp.Request = args.Request
-  putOp.Type = PutOp
-  putOp.Key = args.Key
-  putOp.Value = args.Value
-  if ok {
-    putOp.Version = oldOp.Version + 1
-  } else {
-    putOp.Version = 1
-  }
-
-  flushed := false
-  if seg.append(*putOp) == false {
-    flushed = true
-    if pb.broadcastFlush(seg.ID, group) {
-      seg = pb.log.newSegment()
-      seg.append(*putOp)
-      if pb.enlistReplicas(*seg) == false {
-        fmt.Println("couldn't enlist enough replicas")
-        reply.Err = ErrBackupFailure
-        return nil
-      } else {
-        group = pb.backups[seg.ID]
-      }
-    } else {
+  for i, op := range ops {
+    if seg.Active && seg.append(op) {
+      pending++
+      continue
+    }
+
+    // what went into the segment before goes out before it is flushed
+    if pending > 0 && ! pb.forwardUnlocked(ops[i-pending:i], seg.ID, group, viewNumber) {
+      fmt.Println("backup failure on fwd")
+      return done, ErrBackupFailure
+    }
+    done += pending
+    pending = 0
+
+    // once an op hasn't fit, the segment is closed even if the flush fails,
+    // since some backups may already have written it out
+    seg.Active = false
+    if ! pb.flushUnlocked(seg.ID, group, viewNumber) {
       fmt.Println("backup failure on flush")
-      reply.Err = ErrBackupFailure
-      return nil
+      return done, ErrBackupFailure
+    }
+
+    // the new segment's backups get op along with it
+    seg = pb.log.newSegment()
+    seg.append(op)
+    if pb.enlistReplicas(*seg) == false {
+      fmt.Println("couldn't enlist enough replicas")
+      return done, ErrBackupFailure
     }
+    group = pb.backups[seg.ID]
+    done++
   }
 
-  if flushed || pb.broadcastForward(*putOp, seg.ID, group) {
-    pb.store[args.Key] = putOp
-  } else {
+  if pending > 0 && ! pb.forwardUnlocked(ops[len(ops)-pending:], seg.ID, group, viewNumber) {
     fmt.Println("backup failure on fwd")
-    reply.Err = ErrBackupFailure
-    return nil
+    return done, ErrBackupFailure
   }
+  return len(ops), OK
+}
 
-  reply.Err = OK
-  return nil
+// broadcastForward and broadcastFlush, without pb.mu. callers must hold
+// pb.logMu and pb.mu.
+func (pb *PBServer) forwardUnlocked(ops []Op, segment int64, group BackupGroup, viewNumber uint) bool {
+  pb.mu.Unlock()
+  defer pb.mu.Lock()
+  return pb.broadcastForward(ops, segment, group, viewNumber)
+}
 
+func (pb *PBServer) flushUnlocked(segment int64, group BackupGroup, viewNumber uint) bool {
+  pb.mu.Unlock()
+  defer pb.mu.Lock()
+  return pb.broadcastFlush(segment, group, viewNumber)
 }
 
-func (pb *PBServer) checkPrimary(server string, segment int64, key string) Err {
-  // correctPrimary := true
-  // if key != "" {
-  //   for i:=0; i < Retries; i++ {
-  //     shard := key2shard(key)
-  //     if pb.view.ShardsToPrimaries[shard] != server {
-  //       // maybe not the primary
-  //       correctPrimary = false
-  //     } else {
-  //       correctPrimary = true
-  //       break
-  //     }
-  //     pb.tick() // update view to be sure
-  //     time.Sleep(50 * time.Millisecond)
-  //   }
-  // }
-  // if correctPrimary == false {
-  //   return ErrWrongServer
-  // }
+// rejects replication from an origin that has been deposed since the view
+// it sent it in, or for a segment we aren't backing up for it. callers must
+// hold pb.backupMu.
+func (pb *PBServer) checkPrimary(origin string, viewnum uint, segment int64) Err {
+  if viewnum < pb.fences[origin] {
+    fmt.Println("Fenced off ", origin, viewnum)
+    return ErrFenced
+  }
 
   if segment != int64(0) {
-    segs, _ := pb.backedUpSegs[server]
+    segs, _ := pb.backedUpSegs[origin]
     _, ok := segs[segment]
     if ok == false {
       fmt.Println("Not responsible!")
@@ -387,15 +554,27 @@ func (pb *PBServer) checkPrimary(server string, segment int64, key string) Err {
   return OK
 }
 
+
+// refuses replication from origin sent in any view before viewnum.
+// callers must hold pb.backupMu.
+func (pb *PBServer) fence(origin string, viewnum uint) {
+  if viewnum > pb.fences[origin] {
+    pb.fences[origin] = viewnum
+  }
+}
+
+// picks ReplicationLevel backups for segment and has them take it on.
+// callers must hold pb.logMu and pb.mu; pb.mu is let go while the
+// candidates answer.
 func (pb *PBServer) enlistReplicas(segment Segment) bool {
 
-  hostsNeeded := RepLevel
+  hostsNeeded := pb.config.ReplicationLevel
 
   availHosts := map[string]bool{}
   enlisted   := map[string]bool{}
 
   for srv, alive := range pb.serversAlive {
-    if alive {
+    if alive && ! pb.draining[srv] {
       availHosts[srv] = alive
     }
   }
@@ -406,6 +585,8 @@ func (pb *PBServer) enlistReplicas(segment Segment) bool {
 
   enlistArgs := new(EnlistReplicaArgs)
   enlistArgs.Origin = pb.me
+  enlistArgs.Incarnation = pb.incarnation
+  enlistArgs.ViewNumber = pb.view.ViewNumber
   enlistArgs.Segment = segment
 
   if numHosts < hostsNeeded {
@@ -415,27 +596,24 @@ func (pb *PBServer) enlistReplicas(segment Segment) bool {
 
   for {
 
-    idxs       := rand.Perm(len(availHosts))
-    candidates := make([]string, numHosts - len(enlisted))
-
-    // copy over available hosts
-    i := 0
-    for key, _ := range availHosts {
-      candidates[i] = key
-      i++
+    // random picks, in as many failure domains as we can
+    candidates := pb.spreadOverDomains(availHosts, enlisted)
+    if len(candidates) < hostsNeeded {
+      fmt.Println("Not enough hosts", len(candidates), hostsNeeded, pb.serversAlive)
+      return false
     }
 
-    replicaIdxs := idxs[:hostsNeeded]
-
     var wg sync.WaitGroup
     replies   := make([]*EnlistReplicaReply, hostsNeeded)
     acks      := make([]bool, hostsNeeded)
 
     to := 10 * time.Millisecond
 
+    pb.mu.Unlock()
+
     // for each guy who hasn't acked
     for i := 0 ; i < hostsNeeded; i++ {
-      host := candidates[replicaIdxs[i]]
+      host := candidates[i]
       if (acks[i] == false) {
         wg.Add(1)
         go func(i int, backup string) {
@@ -449,8 +627,10 @@ func (pb *PBServer) enlistReplicas(segment Segment) bool {
     }
     wg.Wait()
 
+    pb.mu.Lock()
+
     for idx, ack := range acks {
-      host := candidates[replicaIdxs[idx]]
+      host := candidates[idx]
       if ack {
         reply := replies[idx]
         if (reply.Err != OK) {
@@ -466,7 +646,7 @@ func (pb *PBServer) enlistReplicas(segment Segment) bool {
     if hostsNeeded == 0 {
 
       bg := new(BackupGroup)
-      bg.Backups = make([]string, RepLevel)
+      bg.Backups = make([]string, pb.config.ReplicationLevel)
 
       i := 0
       for k, _ := range enlisted {
@@ -478,7 +658,9 @@ func (pb *PBServer) enlistReplicas(segment Segment) bool {
       return true
     }
 
+    pb.mu.Unlock()
     time.Sleep(to)
+    pb.mu.Lock()
     if to < 10 * time.Second {
       to *= 2
     }
@@ -487,6 +669,47 @@ func (pb *PBServer) enlistReplicas(segment Segment) bool {
   return false
 }
 
+// hosts in random order, except that those in a failure domain that neither
+// we nor any of chosen are in come first, one per domain. callers must hold
+// pb.mu.
+func (pb *PBServer) spreadOverDomains(hosts map[string]bool, chosen map[string]bool) []string {
+  shuffled := make([]string, 0, len(hosts))
+  for host, _ := range hosts {
+    shuffled = append(shuffled, host)
+  }
+  for i, j := range rand.Perm(len(shuffled)) {
+    shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+  }
+
+  taken := map[string]bool{pb.domainOf(pb.me): true}
+  for host, _ := range chosen {
+    taken[pb.domainOf(host)] = true
+  }
+
+  spread := make([]string, 0, len(shuffled))
+  rest   := make([]string, 0, len(shuffled))
+  for _, host := range shuffled {
+    domain := pb.domainOf(host)
+    if taken[domain] {
+      rest = append(rest, host)
+    } else {
+      taken[domain] = true
+      spread = append(spread, host)
+    }
+  }
+  return append(spread, rest...)
+}
+
+// the failure domain server declared, or the server itself if it didn't.
+// callers must hold pb.mu.
+func (pb *PBServer) domainOf(server string) string {
+  domain, ok := pb.domains[server]
+  if ! ok {
+    return server
+  }
+  return domain
+}
+
 func (pb *PBServer) Kill(args *KillArgs, reply *KillReply) error {
   pb.kill()
   return nil
@@ -500,29 +723,29 @@ func (pb *PBServer) EnlistReplica(args *EnlistReplicaArgs, reply *EnlistReplicaR
   segID  := args.Segment.ID
   origin := args.Origin
 
-  segs, segok := pb.backedUpSegs[origin]
-
-  if ! segok {
-    // segment uuids -> set of shard ids
-    segs = make(map[int64] map[int]bool)
+  if pb.retiring {
+    reply.Err = ErrRetiring
+    return nil
   }
 
-  _, shardok := segs[segID]
+  err := pb.noteIncarnation(origin, args.Incarnation)
+  if err == OK {
+    err = pb.checkPrimary(origin, args.ViewNumber, 0)
+  }
+  if err != OK {
+    reply.Err = err
+    return nil
+  }
 
-  if shardok == false {
+  _, enlisted := pb.backedUpSegs[origin][segID]
 
-    segs[segID] = make(map[int]bool)
+  if enlisted == false {
 
     newSeg := args.Segment
 
     pb.buffers[origin] = &newSeg
 
-    // record shardnum for op in buffer
-    for _, op := range args.Segment.Ops {
-      pb.recordShardBackup(origin, segID, op)
-    }
-
-    pb.backedUpSegs[origin] = segs
+    pb.recordSegment(origin, args.Incarnation, args.Segment)
 
   } else {
     fmt.Println("replica already enlisted")
@@ -534,18 +757,90 @@ func (pb *PBServer) EnlistReplica(args *EnlistReplicaArgs, reply *EnlistReplicaR
 
 }
 
+
+// rejects replication from a replaced incarnation of origin, and notices when
+// origin has restarted. callers must hold pb.backupMu.
+func (pb *PBServer) noteIncarnation(origin string, incarnation int64) Err {
+  err := pb.checkIncarnation(origin, incarnation)
+  if err != OK {
+    return err
+  }
+
+  if incarnation > pb.incarnations[origin] {
+    // origin restarted; its predecessor never got to flush, and whatever
+    // it was fenced off for doesn't apply to the new one
+    pb.flushBuffer(origin)
+    pb.incarnations[origin] = incarnation
+    delete(pb.fences, origin)
+  }
+  return OK
+}
+
+
+// records that we back up seg for the given incarnation of origin: which
+// shards it has ops for, and what it says about the rest of origin's log.
+// callers must hold pb.backupMu.
+func (pb *PBServer) recordSegment(origin string, incarnation int64, seg Segment) {
+
+  segs, segok := pb.backedUpSegs[origin]
+
+  if ! segok {
+    // segment uuids -> set of shard ids
+    segs = make(map[int64] map[int]bool)
+    pb.backedUpSegs[origin] = segs
+  }
+
+  segs[seg.ID] = make(map[int]bool)
+
+  // record shardnum for op in buffer
+  for _, op := range seg.Ops {
+    pb.recordShardBackup(origin, seg.ID, op)
+  }
+
+  pb.segIncarnations[seg.ID] = incarnation
+
+  // a newer segment's digest lists everything the older ones did
+  digests, ok := pb.digests[origin]
+  if ! ok {
+    digests = make(map[int64][]int64)
+    pb.digests[origin] = digests
+  }
+  digest := append(append([]int64{}, seg.Digest...), seg.ID)
+  if len(digest) > len(digests[incarnation]) {
+    digests[incarnation] = digest
+  }
+}
+
 func (pb *PBServer) FlushSeg(args *FlushSegArgs, reply *FlushSegReply) error {
   pb.backupMu.Lock()
   defer pb.backupMu.Unlock()
 
-  err := pb.checkPrimary(args.Origin, args.OldSegment, "")
+  err := pb.checkIncarnation(args.Origin, args.Incarnation)
+  if err == OK {
+    err = pb.checkPrimary(args.Origin, args.ViewNumber, args.OldSegment)
+  }
 
   if err != OK {
     reply.Err = err
     return nil
   }
 
-  segPtr, ok := pb.buffers[args.Origin]
+  // a retried flush can turn up after the next segment's buffer exists
+  buf, ok := pb.buffers[args.Origin]
+  if ok && buf.ID == args.OldSegment {
+    pb.flushBuffer(args.Origin)
+  }
+
+  reply.Err = OK
+  return nil
+}
+
+
+// writes origin's buffered segment to disk, if it has one.
+// callers must hold pb.backupMu.
+func (pb *PBServer) flushBuffer(origin string) {
+
+  segPtr, ok := pb.buffers[origin]
 
   if ok {
 
@@ -553,25 +848,41 @@ func (pb *PBServer) FlushSeg(args *FlushSegArgs, reply *FlushSegReply) error {
     seg := *segPtr
 
     // free buffer
-    delete(pb.buffers, args.Origin)
+    delete(pb.buffers, origin)
+    pb.persisting[seg.ID] = segPtr
 
      // write segment to disk in the background
-    go func() {
+    go pb.persistSegment(origin, seg)
 
-      dirpath := path.Join(SegPath, pb.meHash)
-      os.Mkdir(dirpath, 0777)
+  }
+}
 
-      dirpath = path.Join(dirpath, pb.md5Digest(args.Origin))
-      os.Mkdir(dirpath, 0777)
 
-      seg.burp(path.Join(dirpath, strconv.Itoa(int(seg.ID))))
+// writes a segment we back up for origin to disk
+func (pb *PBServer) persistSegment(origin string, seg Segment) {
 
-    }()
+  dirpath := path.Join(pb.config.SegPath, pb.meHash)
+  os.Mkdir(dirpath, 0777)
 
-  }
+  dirpath = path.Join(dirpath, pb.md5Digest(origin))
+  os.Mkdir(dirpath, 0777)
 
-  reply.Err = OK
-  return nil
+  seg.burp(path.Join(dirpath, strconv.Itoa(int(seg.ID))))
+
+  pb.backupMu.Lock()
+  delete(pb.persisting, seg.ID)
+  pb.backupMu.Unlock()
+}
+
+
+// rejects replication from an incarnation of origin that has since been
+// replaced. callers must hold pb.backupMu.
+func (pb *PBServer) checkIncarnation(origin string, incarnation int64) Err {
+  if incarnation < pb.incarnations[origin] {
+    fmt.Println("Stale incarnation of ", origin)
+    return ErrStaleIncarnation
+  }
+  return OK
 }
 
 func (pb *PBServer) ForwardOp(args *ForwardOpArgs, reply *ForwardOpReply) error {
@@ -580,9 +891,11 @@ func (pb *PBServer) ForwardOp(args *ForwardOpArgs, reply *ForwardOpReply) error
 
   seg    := args.Segment
   origin := args.Origin
-  op     := args.Op
 
-  err := pb.checkPrimary(origin, seg, op.Key)
+  err := pb.checkIncarnation(origin, args.Incarnation)
+  if err == OK {
+    err = pb.checkPrimary(origin, args.ViewNumber, seg)
+  }
   if err != OK {
     reply.Err = err
     return nil
@@ -590,11 +903,13 @@ func (pb *PBServer) ForwardOp(args *ForwardOpArgs, reply *ForwardOpReply) error
 
   buf, ok := pb.buffers[origin]
   if ok {
-    res := buf.append(op)
-    pb.recordShardBackup(origin, seg, op)
-    if res == false {
-      fmt.Println("buffer size exceeded in replica. should never happen.")
-      os.Exit(1)
+    for _, op := range args.Ops {
+      res := buf.append(op)
+      pb.recordShardBackup(origin, seg, op)
+      if res == false {
+        fmt.Println("buffer size exceeded in replica. should never happen.")
+        os.Exit(1)
+      }
     }
   } else {
     // TODO: when can this happen?
@@ -607,7 +922,9 @@ func (pb *PBServer) ForwardOp(args *ForwardOpArgs, reply *ForwardOpReply) error
 }
 
 
-func (pb *PBServer) broadcastForward(op Op, segment int64, group BackupGroup) bool {
+// sends ops to every backup in group, as of view viewNumber. true once all
+// of them have them.
+func (pb *PBServer) broadcastForward(ops []Op, segment int64, group BackupGroup, viewNumber uint) bool {
 
   numOfBackups := len(group.Backups)
 
@@ -619,10 +936,12 @@ func (pb *PBServer) broadcastForward(op Op, segment int64, group BackupGroup) bo
   // set the args
   fwdArgs  := new(ForwardOpArgs)
   fwdArgs.Origin = pb.me
-  fwdArgs.Op = op
+  fwdArgs.Incarnation = pb.incarnation
+  fwdArgs.ViewNumber = viewNumber
+  fwdArgs.Ops = ops
   fwdArgs.Segment = segment
 
-  for i:= 0; i < Retries; i++ {
+  for i:= 0; i < pb.config.Retries; i++ {
 
     to := 10 * time.Millisecond
 
@@ -672,17 +991,23 @@ func (pb *PBServer) broadcastForward(op Op, segment int64, group BackupGroup) bo
 }
 
 
-func (pb *PBServer) broadcastFlush(segment int64, group BackupGroup) bool {
+// has every backup in group write segment out, as of view viewNumber. true
+// once all of them have.
+func (pb *PBServer) broadcastFlush(segment int64, group BackupGroup, viewNumber uint) bool {
 
   replies := make([]*FlushSegReply, len(group.Backups))
   acks    := make([]bool, len(group.Backups))
 
+  var wg sync.WaitGroup
+
   // set the args
   flshArgs  := new(FlushSegArgs)
   flshArgs.Origin = pb.me
+  flshArgs.Incarnation = pb.incarnation
+  flshArgs.ViewNumber = viewNumber
   flshArgs.OldSegment = segment
 
-  for i:= 0; i < Retries; i++ {
+  for i:= 0; i < pb.config.Retries; i++ {
 
     to := 10 * time.Millisecond
     count := 0
@@ -691,14 +1016,17 @@ func (pb *PBServer) broadcastFlush(segment int64, group BackupGroup) bool {
     for idx, backup := range group.Backups {
       if (acks[idx] == false ) {
         count += 1
+        wg.Add(1)
         go func(idx int, backup string) {
           flshReply := new(FlushSegReply)
           ack := call(backup, "PBServer.FlushSeg", pb.networkMode, flshArgs, flshReply)
           replies[idx] = flshReply
           acks[idx] = ack
+          wg.Done()
         }(idx, backup)
       }
     }
+    wg.Wait()
 
     numAcked := 0
 
@@ -731,15 +1059,74 @@ func (pb *PBServer) broadcastFlush(segment int64, group BackupGroup) bool {
 
 
 
+// what we tell the viewservice about how busy we are
+func (pb *PBServer) load() viewservice.ServerLoad {
+  load := viewservice.ServerLoad{}
+  load.Capacity = pb.capacity
+
+  pb.mu.Lock()
+  load.StoreBytes = pb.storeBytes
+  pb.mu.Unlock()
+
+  pb.backupMu.Lock()
+  for _, segs := range pb.backedUpSegs {
+    load.BackedUpSegments += len(segs)
+  }
+  pb.backupMu.Unlock()
+
+  return load
+}
+
+// works out the load for the next ping to report
+func (pb *PBServer) refreshLoad() {
+  pb.loadMu.Lock()
+  if pb.refreshing {
+    pb.loadMu.Unlock()
+    return
+  }
+  pb.refreshing = true
+  pb.loadMu.Unlock()
+
+  load := pb.load()
+
+  pb.loadMu.Lock()
+  pb.lastLoad = load
+  pb.refreshing = false
+  pb.loadMu.Unlock()
+}
+
 func (pb *PBServer) tick() {
-  view, serversAlive, err := pb.clerk.Ping(pb.view.ViewNumber)
+  go pb.refreshLoad()
+  pb.loadMu.Lock()
+  load := pb.lastLoad
+  pb.loadMu.Unlock()
+
+  pb.mu.Lock()
+  viewNumber := pb.view.ViewNumber
+  pb.mu.Unlock()
+
+  view, serversAlive, err := pb.clerk.PingWithLoad(viewNumber, load)
   if err == nil {
+    draining := pb.clerk.Draining()
+    domains := pb.clerk.Domains()
+    leaseExpiry := pb.clerk.LeaseExpiry()
+
     // don't bother waiting for the lock.
     go func() {
+      pb.updateView(view, serversAlive)
+
       pb.mu.Lock()
-      if pb.view.ViewNumber < view.ViewNumber {
-        pb.view = view
-        pb.serversAlive = serversAlive
+      pb.draining = draining
+      if serversAlive[pb.me] && ! draining[pb.me] {
+        // in service, so any drain was called off. a decommissioned
+        // server isn't alive, and stays retired
+        pb.backupMu.Lock()
+        pb.retiring = false
+        pb.backupMu.Unlock()
+      }
+      pb.domains = domains
+      if leaseExpiry.After(pb.leaseExpiry) {
+        pb.leaseExpiry = leaseExpiry
       }
       pb.mu.Unlock()
     }()
@@ -747,21 +1134,76 @@ func (pb *PBServer) tick() {
 }
 
 
+// takes on view if it is newer than ours
+func (pb *PBServer) updateView(view viewservice.View, serversAlive map[string]bool) {
+  pb.mu.Lock()
+  defer pb.mu.Unlock()
+
+  if pb.view.ViewNumber < view.ViewNumber {
+    // primaries that lost all their shards without being alive to hand them
+    // off have been deposed
+    owners := make(map[string]bool)
+    for _, primary := range view.ShardsToPrimaries {
+      owners[primary] = true
+    }
+    pb.backupMu.Lock()
+    for _, primary := range pb.view.ShardsToPrimaries {
+      if ! owners[primary] && ! serversAlive[primary] {
+        pb.fence(primary, view.ViewNumber)
+      }
+    }
+    pb.backupMu.Unlock()
+
+    pb.view = view
+    pb.serversAlive = serversAlive
+  }
+  pb.releaseFrozen()
+}
+
+
 // tell the viewserver which shards you have segments for and which segments you have
 func (pb *PBServer) QuerySegments(args *QuerySegmentsArgs, reply *QuerySegmentsReply) error {
+  pb.backupMu.Lock()
+  defer pb.backupMu.Unlock()
 
-  // subset of backedUpSegs relevant to query
+  // subset of backedUpSegs relevant to query: the segments written by the
+  // incarnation that died, if the viewservice knows which one that was
   relevant := make(map[string]map[int64]map[int]bool)
 
   for dead, _ := range args.DeadPrimaries {
+    incarnation, known := args.Incarnations[dead]
+
+    // recovery has started; whatever the dead primary sends from now on
+    // might not be seen by it. (if we've heard from a newer incarnation,
+    // the dead one is turned away anyway.)
+    if incarnation >= pb.incarnations[dead] {
+      pb.fence(dead, args.ViewNumber)
+    }
     segMap, ok := pb.backedUpSegs[dead]
     if ok {
-      relevant[dead] = segMap
+      relevant[dead] = make(map[int64]map[int]bool)
+      for seg, shards := range segMap {
+        if ! known || incarnation == 0 || pb.segIncarnations[seg] == incarnation {
+          relevant[dead][seg] = shards
+        }
+      }
+    }
+  }
+
+  // and what each of their logs should contain
+  digests := make(map[string][]int64)
+  for dead, _ := range args.DeadPrimaries {
+    incarnation, known := args.Incarnations[dead]
+    for inc, digest := range pb.digests[dead] {
+      if (! known || incarnation == 0 || inc == incarnation) && len(digest) > len(digests[dead]) {
+        digests[dead] = digest
+      }
     }
   }
 
   reply.ServerName = pb.me
   reply.BackedUpSegments = relevant
+  reply.Digests = digests
 
   return nil
 }
@@ -775,6 +1217,9 @@ func (pb *PBServer) PullSegmentsByShards(args *PullSegmentsByShardsArgs, reply *
     go func(i int, segId int64) {
       pb.backupMu.Lock()
       buf, ok := pb.buffers[args.Owner]
+      if ! ok || buf.ID != segId {
+        buf, ok = pb.persisting[segId]
+      }
       pb.backupMu.Unlock()
 
       oldSeg := &Segment{}
@@ -783,13 +1228,13 @@ func (pb *PBServer) PullSegmentsByShards(args *PullSegmentsByShardsArgs, reply *
         oldSeg = buf
       } else {
         fname := strconv.Itoa(int(segId))
-        oldSeg.slurp(path.Join(SegPath, pb.meHash, pb.md5Digest(args.Owner), fname))
+        oldSeg.slurp(path.Join(pb.config.SegPath, pb.meHash, pb.md5Digest(args.Owner), fname))
       }
 
-      newSeg := Segment{}
+      newSeg := Segment{Limit: oldSeg.Limit}
       // filter out operations from irrelevant shards
       for _, op := range oldSeg.Ops {
-        if args.Shards[key2shard(op.Key)] {
+        if opInPartitions(op, args.Partitions) {
           newSeg.append(op)
         }
       }
@@ -821,6 +1266,9 @@ func (pb *PBServer) ElectRecoveryMaster(args *ElectRecoveryMasterArgs, reply *El
 
   recoveredData := make(map[int]int)
 
+  // what we last told the viewservice about each shard
+  progress := make(map[int]viewservice.RecoveryProgressArgs)
+
   for {
 
     // fmt.Println(recoveryData)
@@ -859,7 +1307,7 @@ func (pb *PBServer) ElectRecoveryMaster(args *ElectRecoveryMasterArgs, reply *El
 
             pullSegmentsArgs  := new(PullSegmentsByShardsArgs)
             pullSegmentsArgs.Segments = []int64{seg}
-            pullSegmentsArgs.Shards   = shards
+            pullSegmentsArgs.Partitions = args.Partitions
             pullSegmentsArgs.Owner    = mainPrimary
 
             pullSegmentsReply := new(PullSegmentsByShardsReply)
@@ -869,11 +1317,7 @@ func (pb *PBServer) ElectRecoveryMaster(args *ElectRecoveryMasterArgs, reply *El
 
             if ok1 {
 
-              recoveryMu.Lock()
               recovered := pullSegmentsReply.Segments[0]
-              segmentsRecovered[seg] = &recovered
-              delete(segmentsInProcess, seg)
-              recoveryMu.Unlock()
 
               for _, newOp := range recovered.Ops {
 
@@ -881,6 +1325,7 @@ func (pb *PBServer) ElectRecoveryMaster(args *ElectRecoveryMasterArgs, reply *El
                 recoveredData[shard] = recoveredData[shard] + newOp.size()
                 recoveryMu.Unlock()
 
+                pb.logMu.Lock()
                 pb.mu.Lock()
 
                 op := newOp
@@ -891,7 +1336,9 @@ func (pb *PBServer) ElectRecoveryMaster(args *ElectRecoveryMasterArgs, reply *El
                   // if the version of the key in the data store is more up-to-date,
                   // don't bother processing the recovered operation.
                   if currOp.Version > op.Version {
+                    pb.noteRequest(&op)
                     pb.mu.Unlock()
+                    pb.logMu.Unlock()
                     continue
                   }
                 }
@@ -903,6 +1350,7 @@ func (pb *PBServer) ElectRecoveryMaster(args *ElectRecoveryMasterArgs, reply *El
                   if pb.enlistReplicas(*seg) == false {
                     fmt.Println("couldn't enlist enough replicas")
                     pb.mu.Unlock()
+                    pb.logMu.Unlock()
                     return
                   } else {
                     group = pb.backups[seg.ID]
@@ -921,9 +1369,10 @@ func (pb *PBServer) ElectRecoveryMaster(args *ElectRecoveryMasterArgs, reply *El
                 pb.backups[seg.ID] = group
 
                 flushed := false
-                if seg.append(op) == false {
+                if ! seg.Active || seg.append(op) == false {
+                  seg.Active = false
                   flushed = true
-                  if pb.broadcastFlush(seg.ID, group) {
+                  if pb.broadcastFlush(seg.ID, group, pb.view.ViewNumber) {
                     seg = pb.log.newSegment()
                     seg.append(op)
                     if pb.enlistReplicas(*seg) == false {
@@ -936,15 +1385,22 @@ func (pb *PBServer) ElectRecoveryMaster(args *ElectRecoveryMasterArgs, reply *El
                   }
                 }
 
-                if flushed || pb.broadcastForward(op, seg.ID, group) {
-                  pb.store[op.Key] = &op
+                if flushed || pb.broadcastForward([]Op{op}, seg.ID, group, pb.view.ViewNumber) {
+                  pb.storeOp(&op)
                 } else {
                   fmt.Println("backup failure on fwd")
                 }
 
                 pb.mu.Unlock()
+                pb.logMu.Unlock()
               }
 
+              // only counts once all of its ops are replayed
+              recoveryMu.Lock()
+              segmentsRecovered[seg] = &recovered
+              delete(segmentsInProcess, seg)
+              recoveryMu.Unlock()
+
             }
 
           }(seg, backup, shard)
@@ -954,14 +1410,31 @@ func (pb *PBServer) ElectRecoveryMaster(args *ElectRecoveryMasterArgs, reply *El
       }
 
       // have we seen all the segments that we need for a given shard?
-      seenAll := true
+      recoveryMu.Lock()
+      fetched := 0
       for seg, _ := range segsToBackups {
         _, seen := segmentsRecovered[seg]
-        if ! seen {
-          seenAll = false
-          break
+        if seen {
+          fetched++
         }
       }
+      replayed := recoveredData[shard]
+      recoveryMu.Unlock()
+
+      seenAll := fetched == len(segsToBackups)
+
+      // let the viewservice know how we're doing
+      last, reported := progress[shard]
+      if ! reported || last.SegmentsFetched != fetched || last.BytesReplayed != int64(replayed) {
+        update := viewservice.RecoveryProgressArgs{}
+        update.ServerName      = pb.me
+        update.Shard           = shard
+        update.SegmentsNeeded  = len(segsToBackups)
+        update.SegmentsFetched = fetched
+        update.BytesReplayed   = int64(replayed)
+        pb.clerk.RecoveryProgress(update)
+        progress[shard] = update
+      }
 
       if seenAll {
         delete(recoveryData, shard)
@@ -999,37 +1472,68 @@ func (pb *PBServer) kill() {
 }
 
 func StartServer(me string, viewServer string) *PBServer {
-  return StartMe(me, viewServer, "unix")
+  return StartMe(me, viewServer, "unix", viewservice.DefaultConfig())
+}
+
+// settings a server is started with
+type ServerOptions struct {
+  Domain string     // failure domain (rack, zone, machine) the server runs in
+  Capacity int64    // bytes of memory the store may use; 0 if unknown
 }
 
-func StartMe(me string, viewServer string, networkMode string) *PBServer {
+func StartMe(me string, viewServer string, networkMode string, config viewservice.Config) *PBServer {
+  return StartWithOptions(me, viewServer, networkMode, config, ServerOptions{})
+}
+
+func StartWithOptions(me string, viewServer string, networkMode string, config viewservice.Config,
+                      opts ServerOptions) *PBServer {
 
   pb := new(PBServer)
 
   pb.me = me
 
   pb.meHash = pb.md5Digest(me)
+  pb.incarnation = time.Now().UnixNano()
+  pb.capacity = opts.Capacity
+  pb.config = config
 
-  os.RemoveAll(path.Join(SegPath, pb.meHash))
-  os.Mkdir(SegPath, 0777)
+  os.RemoveAll(path.Join(config.SegPath, pb.meHash))
+  os.Mkdir(config.SegPath, 0777)
 
   pb.view = viewservice.View{}
 
   pb.clerk = viewservice.MakeClerk(me, viewServer, networkMode)
+  pb.clerk.SetIncarnation(pb.incarnation)
+  pb.clerk.SetDomain(opts.Domain)
+  pb.clerk.SetConfig(config)
 
   // initialize main data structures
   pb.log = new(Log)
-  pb.log.init()
+  pb.log.init(config.SegLimit)
 
   pb.store = map[string]*Op{}
+  pb.requests = make(map[int64]*Op)
 
   pb.buffers = map[string]*Segment{}
+  pb.persisting = map[int64]*Segment{}
 
   pb.backedUpSegs = map[string]map[int64]map[int]bool{}
+  pb.incarnations = make(map[string]int64)
+  pb.segIncarnations = make(map[int64]int64)
+  pb.fences = make(map[string]uint)
+  pb.digests = make(map[string]map[int64][]int64)
 
   pb.backups = map[int64]BackupGroup{}
 
   pb.serversAlive = map[string]bool{}
+  pb.draining = map[string]bool{}
+  pb.domains = map[string]string{}
+
+  pb.migrating = map[int]map[string]bool{}
+
+  pb.frozen = map[int]time.Time{}
+
+  pb.lastLoad = pb.load()
 
   pb.networkMode = networkMode
 
@@ -1096,10 +1600,23 @@ func StartMe(me string, viewServer string, networkMode string) *PBServer {
   go func() {
     for pb.dead == false {
       pb.tick()
-      time.Sleep(100 * time.Millisecond)
-      //time.Sleep(viewservice.PingInterval)
+      time.Sleep(config.PingInterval)
     }
   }()
 
+  // hear about new views as soon as they exist, rather than on the next ping
+  pb.clerk.Subscribe(0, func() bool { return pb.dead }, func(view viewservice.View, serversAlive map[string]bool) bool {
+    pb.mu.Lock()
+    registered := pb.view.ViewNumber > 0
+    pb.mu.Unlock()
+
+    // the first view has to come from a ping, which the viewservice holds
+    // back until it has dealt with our previous incarnation
+    if registered {
+      pb.updateView(view, serversAlive)
+    }
+    return true
+  })
+
   return pb
 }
@@ -35,6 +35,89 @@ func hostname(base string, hosts map[int]bool) string {
   return fmt.Sprintf("%s:%d", base, i)
 }
 
+// a viewservice and the storage servers that registered with it
+type cluster struct {
+  vs      *viewservice.ViewServer
+  vshost  string
+  mode    string
+  config  viewservice.Config
+  names   map[int]bool
+  servers []*PBServer
+  byName  map[string]*PBServer
+}
+
+// starts a viewservice and n servers, and waits for critical mass
+func startCluster(t *testing.T, config viewservice.Config, n int) (*cluster, *Clerk) {
+  runtime.GOMAXPROCS(4)
+
+  c := &cluster{mode: "tcp", config: config}
+  c.names = make(map[int]bool)
+  c.byName = make(map[string]*PBServer)
+
+  c.vshost = c.host()
+  os.Remove(viewservice.JournalName(c.vshost))
+  c.vs = viewservice.StartMe(c.vshost, c.mode, config)
+
+  for i:=0; i < n; i++ {
+    c.start()
+  }
+
+  ck := c.clerk()
+
+  // allow some time for critical mass to be reached
+  time.Sleep(1 * time.Second)
+
+  if len(ck.GetView().ShardsToPrimaries) == 0 {
+    c.kill()
+    t.Fatalf("critical mass of %d servers was never reached", n)
+  }
+  return c, ck
+}
+
+func (c *cluster) host() string {
+  return hostname("127.0.0.1", c.names)
+}
+
+func (c *cluster) clerk() *Clerk {
+  ck := MakeClerk(c.host(), c.vshost, c.mode)
+  ck.SetConfig(c.config)
+  return ck
+}
+
+func (c *cluster) start() *PBServer {
+  server := StartMe(c.host(), c.vshost, c.mode, c.config)
+  c.servers = append(c.servers, server)
+  c.byName[server.me] = server
+  return server
+}
+
+func (c *cluster) kill() {
+  c.vs.Kill()
+  for i:=0; i < len(c.servers); i++ {
+    c.servers[i].kill()
+  }
+}
+
+// waits for server to be found dead and recovered, and for each of shards
+// to have a primary other than it
+func awaitRecovery(ck *Clerk, server *PBServer, shards ...int) bool {
+  for iters := 0; iters < 100; iters++ {
+    time.Sleep(100 * time.Millisecond)
+    view := ck.GetView()
+    status := ck.Status()
+    _, inProcess := status.RecoveryInProcess[server.me]
+    recovered := ! inProcess && ! status.ServersAlive[server.me]
+    for _, shard := range shards {
+      primary, ok := view.ShardsToPrimaries[shard]
+      recovered = recovered && ok && primary != server.me
+    }
+    if recovered {
+      return true
+    }
+  }
+  return false
+}
+
 
 func Test1(t *testing.T) {
   runtime.GOMAXPROCS(4)
@@ -48,18 +131,21 @@ func Test1(t *testing.T) {
   // vshost := port("vs")
   vshost := hostname(localhost, names)
 
-  vs := viewservice.StartMe(vshost, mode)
-
   numOfClients := 5
   numOfServers := 8
 
+  os.Remove(viewservice.JournalName(vshost))
+  config := viewservice.DefaultConfig()
+  config.CriticalMass = numOfServers
+  vs := viewservice.StartMe(vshost, mode, config)
+
   clients := make([]*Clerk, numOfClients)
   servers := make([]*PBServer, numOfServers)
 
   for i:=0; i < numOfServers; i++ {
     // hostname := port(fmt.Sprintf("server%d", i))
     hostname := hostname(localhost, names)
-    servers[i] = StartMe(hostname, vshost, mode)
+    servers[i] = StartMe(hostname, vshost, mode, config)
   }
 
   for i:=0; i < numOfClients; i++ {
@@ -121,6 +207,1140 @@ func Test1(t *testing.T) {
 
 }
 
+func TestRebalance(t *testing.T) {
+  config := viewservice.DefaultConfig()
+  c, ck := startCluster(t, config, config.CriticalMass)
+
+  nkeys := 200
+  for i:=0; i < nkeys; i++ {
+    ck.Put(fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i))
+  }
+
+  fmt.Printf("Test: Late server is given shards ...\n")
+
+  late := c.start()
+
+  wanted := config.NumberOfShards / len(c.servers)
+  owned  := 0
+  for iters := 0; iters < 100 && owned < wanted; iters++ {
+    time.Sleep(100 * time.Millisecond)
+    owned = 0
+    for _, primary := range ck.GetView().ShardsToPrimaries {
+      if primary == late.me {
+        owned++
+      }
+    }
+  }
+  if owned < wanted {
+    t.Fatalf("late server owns %d shards, wanted %d", owned, wanted)
+  }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Moved shards keep their data ...\n")
+
+  for i:=0; i < nkeys; i++ {
+    v := ck.Get(fmt.Sprintf("k%d", i))
+    if v != fmt.Sprintf("v%d", i) {
+      t.Fatalf("Get(k%d) = %v, wanted v%d", i, v, i)
+    }
+  }
+
+  for i:=0; i < nkeys; i++ {
+    ck.Put(fmt.Sprintf("k%d", i), fmt.Sprintf("w%d", i))
+  }
+  for i:=0; i < nkeys; i++ {
+    v := ck.Get(fmt.Sprintf("k%d", i))
+    if v != fmt.Sprintf("w%d", i) {
+      t.Fatalf("Get(k%d) = %v, wanted w%d", i, v, i)
+    }
+  }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Operator moves a shard ...\n")
+
+  shard := ck.WhichShard("k0")
+  from  := ck.GetView().ShardsToPrimaries[shard]
+  to    := c.servers[0].me
+  if from == to {
+    to = c.servers[1].me
+  }
+
+  if err := ck.MoveShard(shard, to); err != viewservice.OK {
+    t.Fatalf("MoveShard failed: %v", err)
+  }
+  if ck.GetView().ShardsToPrimaries[shard] != to {
+    t.Fatalf("shard %d not moved to %v", shard, to)
+  }
+  if v := ck.Get("k0"); v != "w0" {
+    t.Fatalf("Get(k0) = %v, wanted w0", v)
+  }
+  if err := ck.MoveShard(config.NumberOfShards, to); err != viewservice.ErrUnknownShard {
+    t.Fatalf("MoveShard of a bogus shard returned %v", err)
+  }
+  fmt.Printf("  ... Passed\n")
+
+  c.kill()
+}
+
+func TestRestartedPrimary(t *testing.T) {
+  config := viewservice.DefaultConfig()
+  c, ck := startCluster(t, config, config.CriticalMass + 1)
+
+  nkeys := 200
+  for i:=0; i < nkeys; i++ {
+    ck.Put(fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i))
+  }
+
+  fmt.Printf("Test: Restarted primary's shards are recovered ...\n")
+
+  // pick a server that is primary for something
+  victim := 0
+  for ; victim < len(c.servers); victim++ {
+    owns := false
+    for _, primary := range ck.GetView().ShardsToPrimaries {
+      owns = owns || primary == c.servers[victim].me
+    }
+    if owns {
+      break
+    }
+  }
+
+  // restart it under the same name, quicker than the viewservice would
+  // notice it missing pings
+  name := c.servers[victim].me
+  c.servers[victim].kill()
+  time.Sleep(100 * time.Millisecond)
+  c.servers[victim] = StartMe(name, c.vshost, c.mode, config)
+
+  recovered := false
+  for iters := 0; iters < 100 && ! recovered; iters++ {
+    time.Sleep(100 * time.Millisecond)
+    status := ck.Status()
+    _, inProcess := status.RecoveryInProcess[name]
+    recovered = ! inProcess && len(status.RecoveryInProcess) == 0 && ck.GetView().ViewNumber > 1
+  }
+  if ! recovered {
+    t.Fatalf("shards of the restarted server were never recovered")
+  }
+
+  var replayed int64 = 0
+  for shard, progress := range ck.Status().Recoveries[name] {
+    if ! progress.Done || progress.SegmentsFetched != progress.SegmentsNeeded {
+      t.Fatalf("shard %d recovery reported unfinished: %+v", shard, progress)
+    }
+    if progress.RecoveryMaster == "" || progress.Elapsed <= 0 {
+      t.Fatalf("shard %d recovery missing details: %+v", shard, progress)
+    }
+    replayed += progress.BytesReplayed
+  }
+  if replayed == 0 {
+    t.Fatalf("no bytes replayed during recovery")
+  }
+
+  for i:=0; i < nkeys; i++ {
+    v := ck.Get(fmt.Sprintf("k%d", i))
+    if v != fmt.Sprintf("v%d", i) {
+      t.Fatalf("Get(k%d) = %v, wanted v%d", i, v, i)
+    }
+  }
+  fmt.Printf("  ... Passed\n")
+
+  c.kill()
+}
+
+func TestLease(t *testing.T) {
+  config := viewservice.DefaultConfig()
+  c, ck := startCluster(t, config, config.CriticalMass)
+
+  nkeys := 100
+  for i:=0; i < nkeys; i++ {
+    ck.Put(fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i))
+  }
+
+  fmt.Printf("Test: Primary stops serving when its lease runs out ...\n")
+
+  before := ck.GetView()
+  primary := before.ShardsToPrimaries[ck.WhichShard("k0")]
+
+  var getReply GetReply
+  ok := call(primary, "PBServer.Get", c.mode, GetArgs{Key: "k0"}, &getReply)
+  if ! ok || getReply.Err != OK || getReply.Value != "v0" {
+    t.Fatalf("Get(k0) from %v = %v %v, wanted v0", primary, getReply.Err, getReply.Value)
+  }
+
+  // nobody can renew their lease
+  c.vs.Kill()
+  time.Sleep(viewservice.LEASE_TIME + viewservice.PING_INTERVAL)
+
+  getReply = GetReply{}
+  ok = call(primary, "PBServer.Get", c.mode, GetArgs{Key: "k0"}, &getReply)
+  if ! ok || getReply.Err != ErrNoLease {
+    t.Fatalf("Get(k0) without a lease = %v, wanted %v", getReply.Err, ErrNoLease)
+  }
+
+  var putReply PutReply
+  ok = call(primary, "PBServer.Put", c.mode, PutArgs{Key: "k0", Value: "x"}, &putReply)
+  if ! ok || putReply.Err != ErrNoLease {
+    t.Fatalf("Put(k0) without a lease = %v, wanted %v", putReply.Err, ErrNoLease)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Primaries serve again once leases are renewed ...\n")
+
+  c.vs = viewservice.StartMe(c.vshost, c.mode, config)
+  time.Sleep(viewservice.LEASE_TIME)
+
+  for i:=0; i < nkeys; i++ {
+    v := ck.Get(fmt.Sprintf("k%d", i))
+    if v != fmt.Sprintf("v%d", i) {
+      t.Fatalf("Get(k%d) = %v, wanted v%d", i, v, i)
+    }
+  }
+
+  status := ck.Status()
+  if len(status.RecoveryInProcess) > 0 || ck.GetView().ViewNumber != before.ViewNumber {
+    t.Fatalf("viewservice restart shouldn't need recovery: %v", status.RecoveryInProcess)
+  }
+  fmt.Printf("  ... Passed\n")
+
+  c.kill()
+}
+
+
+func TestFencing(t *testing.T) {
+  config := viewservice.DefaultConfig()
+  c, ck := startCluster(t, config, config.CriticalMass)
+
+  ck.Put("a", "1")
+
+  fmt.Printf("Test: Backups refuse writes from a primary under recovery ...\n")
+
+  view := ck.GetView()
+  primary := c.byName[view.ShardsToPrimaries[ck.WhichShard("a")]]
+
+  primary.mu.Lock()
+  group := primary.backups[primary.log.CurrSegID]
+  primary.mu.Unlock()
+  if len(group.Backups) == 0 {
+    t.Fatalf("no backups for %v's current segment", primary.me)
+  }
+  backup := group.Backups[0]
+
+  // as if the viewservice had started recovering the primary
+  queryArgs := &QuerySegmentsArgs{}
+  queryArgs.DeadPrimaries = map[string][]int{primary.me: []int{ck.WhichShard("a")}}
+  queryArgs.Incarnations = map[string]int64{primary.me: primary.incarnation}
+  queryArgs.ViewNumber = view.ViewNumber + 1
+  var queryReply QuerySegmentsReply
+  if ! call(backup, "PBServer.QuerySegments", c.mode, queryArgs, &queryReply) {
+    t.Fatalf("QuerySegments to %v failed", backup)
+  }
+
+  var putReply PutReply
+  ok := call(primary.me, "PBServer.Put", c.mode, PutArgs{Key: "a", Value: "2"}, &putReply)
+  if ! ok || putReply.Err != ErrBackupFailure {
+    t.Fatalf("Put from a fenced primary = %v, wanted %v", putReply.Err, ErrBackupFailure)
+  }
+
+  fwdArgs := &ForwardOpArgs{Origin: primary.me, Incarnation: primary.incarnation}
+  fwdArgs.Ops = []Op{Op{Key: "a", Value: "3", Type: PutOp}}
+  fwdArgs.ViewNumber = view.ViewNumber
+  var fwdReply ForwardOpReply
+  call(backup, "PBServer.ForwardOp", c.mode, fwdArgs, &fwdReply)
+  if fwdReply.Err != ErrFenced {
+    t.Fatalf("ForwardOp from the old view = %v, wanted %v", fwdReply.Err, ErrFenced)
+  }
+
+  // a later view is a new epoch
+  fwdArgs.ViewNumber = view.ViewNumber + 1
+  fwdReply = ForwardOpReply{}
+  call(backup, "PBServer.ForwardOp", c.mode, fwdArgs, &fwdReply)
+  if fwdReply.Err == ErrFenced {
+    t.Fatalf("ForwardOp from the new view was fenced")
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  c.kill()
+}
+
+
+func TestDrain(t *testing.T) {
+  config := viewservice.DefaultConfig()
+  c, ck := startCluster(t, config, config.CriticalMass + 1)
+
+  nkeys := 500
+  for i:=0; i < nkeys; i++ {
+    ck.Put(fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i))
+  }
+
+  fmt.Printf("Test: Drained server gives up its shards and backups ...\n")
+
+  // a server that is both a primary and a backup
+  drained := c.servers[0]
+  if err := ck.Drain(drained.me); err != viewservice.OK {
+    t.Fatalf("Drain failed: %v", err)
+  }
+
+  done := false
+  for iters := 0; iters < 200 && ! done; iters++ {
+    time.Sleep(100 * time.Millisecond)
+    done = ck.Status().Decommissioned[drained.me]
+  }
+  if ! done {
+    t.Fatalf("%v never decommissioned", drained.me)
+  }
+
+  status := ck.Status()
+  if status.ServersAlive[drained.me] {
+    t.Fatalf("decommissioned server still alive")
+  }
+  if len(status.RecoveryInProcess) > 0 {
+    t.Fatalf("drain shouldn't need recovery: %v", status.RecoveryInProcess)
+  }
+  for shard, primary := range ck.GetView().ShardsToPrimaries {
+    if primary == drained.me {
+      t.Fatalf("decommissioned server still primary for shard %d", shard)
+    }
+  }
+
+  for i:=0; i < nkeys; i++ {
+    v := ck.Get(fmt.Sprintf("k%d", i))
+    if v != fmt.Sprintf("v%d", i) {
+      t.Fatalf("Get(k%d) = %v, wanted v%d", i, v, i)
+    }
+  }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Data survives a failure after the drain ...\n")
+
+  drained.kill()
+
+  // the other backups of each segment the drained server had are still
+  // around, so any single failure can be recovered from
+  victim := c.servers[1]
+  victim.kill()
+
+  if ! awaitRecovery(ck, victim) {
+    t.Fatalf("%v was never recovered", victim.me)
+  }
+
+  for i:=0; i < nkeys; i++ {
+    v := ck.Get(fmt.Sprintf("k%d", i))
+    if v != fmt.Sprintf("v%d", i) {
+      t.Fatalf("Get(k%d) = %v, wanted v%d", i, v, i)
+    }
+  }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Handoff reports backups of dead servers ...\n")
+
+  // somebody that backed up the victim can't pass that on to anyone
+  var backup *PBServer
+  for _, server := range c.servers[2:] {
+    server.backupMu.Lock()
+    if len(server.backedUpSegs[victim.me]) > 0 {
+      backup = server
+    }
+    server.backupMu.Unlock()
+  }
+  if backup == nil {
+    t.Fatalf("nobody backed up %v", victim.me)
+  }
+
+  // only a server that is being drained hands off
+  var reply HandoffBackupsReply
+  backup.HandoffBackups(&HandoffBackupsArgs{}, &reply)
+  if reply.Err != ErrNotDraining {
+    t.Fatalf("handoff without a drain returned %v, wanted %v", reply.Err, ErrNotDraining)
+  }
+  if err := ck.Drain(backup.me); err != viewservice.OK {
+    t.Fatalf("Drain failed: %v", err)
+  }
+  heard := false
+  for iters := 0; iters < 50 && ! heard; iters++ {
+    time.Sleep(100 * time.Millisecond)
+    backup.mu.Lock()
+    heard = backup.draining[backup.me]
+    backup.mu.Unlock()
+  }
+  if ! heard {
+    t.Fatalf("%v never heard it was being drained", backup.me)
+  }
+
+  reply = HandoffBackupsReply{}
+  backup.HandoffBackups(&HandoffBackupsArgs{}, &reply)
+  reported := false
+  for _, origin := range reply.Unreplaced {
+    reported = reported || origin == victim.me
+  }
+  if reply.Err != OK || ! reported {
+    t.Fatalf("handoff returned %v, %v; wanted %v among the unreplaced", reply.Err, reply.Unreplaced, victim.me)
+  }
+  fmt.Printf("  ... Passed\n")
+
+  c.kill()
+}
+
+func TestSplitShard(t *testing.T) {
+  config := viewservice.DefaultConfig()
+  c, ck := startCluster(t, config, config.CriticalMass + 1)
+
+  // keys that will end up in either half of k0's shard
+  view  := ck.GetView()
+  shard := view.ShardForKey("k0")
+  mod   := view.PartitionOf(shard).Mod
+  lower := viewservice.Partition{Shard: shard, Mod: 2 * mod}
+  upper := viewservice.Partition{Shard: shard + int(mod), Mod: 2 * mod}
+
+  keys := make([]string, 0)
+  inLower, inUpper := 0, 0
+  for i:=0; i < 100000 && (inLower < 5 || inUpper < 5); i++ {
+    key := fmt.Sprintf("k%d", i)
+    if lower.Holds(key) {
+      inLower++
+      keys = append(keys, key)
+    } else if upper.Holds(key) {
+      inUpper++
+      keys = append(keys, key)
+    }
+  }
+  for _, key := range keys {
+    ck.Put(key, "v" + key)
+  }
+
+  fmt.Printf("Test: Split shard keeps its keys ...\n")
+
+  child, err := ck.SplitShard(shard, "")
+  if err != viewservice.OK || child != upper.Shard {
+    t.Fatalf("SplitShard(%d) = %d, %v; wanted %d", shard, child, err, upper.Shard)
+  }
+  view = ck.GetView()
+  if view.ShardsToPrimaries[child] != view.ShardsToPrimaries[shard] {
+    t.Fatalf("new half went to %v instead of staying with %v",
+      view.ShardsToPrimaries[child], view.ShardsToPrimaries[shard])
+  }
+  for _, key := range keys {
+    if upper.Holds(key) != (ck.WhichShard(key) == child) {
+      t.Fatalf("%v routed to shard %d", key, ck.WhichShard(key))
+    }
+    if v := ck.Get(key); v != "v" + key {
+      t.Fatalf("Get(%v) = %v, wanted v%v", key, v, key)
+    }
+  }
+
+  // half of them are written again after the split
+  for i, key := range keys {
+    if i % 2 == 0 {
+      ck.Put(key, "w" + key)
+    }
+  }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Both halves are recovered from the log ...\n")
+
+  victim := c.byName[view.ShardsToPrimaries[shard]]
+  victim.kill()
+
+  if ! awaitRecovery(ck, victim, shard, child) {
+    t.Fatalf("%v was never recovered", victim.me)
+  }
+  view = ck.GetView()
+
+  check := func() {
+    for i, key := range keys {
+      wanted := "v" + key
+      if i % 2 == 0 {
+        wanted = "w" + key
+      }
+      if v := ck.Get(key); v != wanted {
+        t.Fatalf("Get(%v) = %v, wanted %v", key, v, wanted)
+      }
+    }
+  }
+  check()
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Halves are merged back ...\n")
+
+  if _, err := ck.MergeShards((shard + 1) % config.NumberOfShards); err != viewservice.ErrNotSplit {
+    t.Fatalf("merging a shard that was never split returned %v", err)
+  }
+
+  // the halves may have been recovered by different servers
+  if err := ck.MoveShard(child, view.ShardsToPrimaries[shard]); err != viewservice.OK {
+    t.Fatalf("MoveShard failed: %v", err)
+  }
+  merged, err := ck.MergeShards(child)
+  if err != viewservice.OK || merged != shard {
+    t.Fatalf("MergeShards(%d) = %d, %v; wanted %d", child, merged, err, shard)
+  }
+  view = ck.GetView()
+  if _, ok := view.ShardsToPrimaries[child]; ok || len(view.Splits) != 0 {
+    t.Fatalf("shard %d still around after merging", child)
+  }
+  check()
+  fmt.Printf("  ... Passed\n")
+
+  c.kill()
+}
+
+func TestRangePartitioning(t *testing.T) {
+  config := viewservice.DefaultConfig()
+  config.RangePartitioned = true
+  c, ck := startCluster(t, config, config.CriticalMass + 1)
+
+  fmt.Printf("Test: Keys are routed by range ...\n")
+
+  nkeys := 200
+  for i:=0; i < nkeys; i++ {
+    ck.Put(fmt.Sprintf("k%03d", i), fmt.Sprintf("v%d", i))
+  }
+
+  view := ck.GetView()
+  if len(view.Ranges) != config.NumberOfShards {
+    t.Fatalf("wanted %d ranges, got %v", config.NumberOfShards, view.Ranges)
+  }
+
+  // all of them are next to each other, so they start out in one shard
+  shard := ck.WhichShard("k000")
+  if ck.WhichShard(fmt.Sprintf("k%03d", nkeys - 1)) != shard {
+    t.Fatalf("k000 and k%03d are in different ranges: %v", nkeys - 1, view.Ranges)
+  }
+
+  child, err := ck.SplitShard(shard, "k100")
+  if err != viewservice.OK {
+    t.Fatalf("SplitShard failed: %v", err)
+  }
+  if _, err := ck.SplitShard(child, "k050"); err != viewservice.ErrBadKey {
+    t.Fatalf("split outside the shard's range returned %v", err)
+  }
+  ck.GetView()
+  if ck.WhichShard("k099") != shard || ck.WhichShard("k100") != child {
+    t.Fatalf("split at k100 routed k099 to %d and k100 to %d", ck.WhichShard("k099"), ck.WhichShard("k100"))
+  }
+
+  for i:=0; i < nkeys; i++ {
+    v := ck.Get(fmt.Sprintf("k%03d", i))
+    if v != fmt.Sprintf("v%d", i) {
+      t.Fatalf("Get(k%03d) = %v, wanted v%d", i, v, i)
+    }
+  }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Ranges are recovered from the log ...\n")
+
+  victim := c.byName[ck.GetView().ShardsToPrimaries[shard]]
+  victim.kill()
+
+  if ! awaitRecovery(ck, victim, shard, child) {
+    t.Fatalf("%v was never recovered", victim.me)
+  }
+
+  for i:=0; i < nkeys; i++ {
+    v := ck.Get(fmt.Sprintf("k%03d", i))
+    if v != fmt.Sprintf("v%d", i) {
+      t.Fatalf("Get(k%03d) = %v, wanted v%d", i, v, i)
+    }
+  }
+  fmt.Printf("  ... Passed\n")
+
+  c.kill()
+}
+
+// pages through a whole scan, pagesize keys at a time
+func scanAll(ck *Clerk, start string, end string, pagesize int) []KeyValue {
+  all := make([]KeyValue, 0)
+  for {
+    pairs, next := ck.Scan(start, end, pagesize)
+    if len(pairs) > pagesize {
+      return nil
+    }
+    all = append(all, pairs...)
+    if next == "" {
+      return all
+    }
+    start = next
+  }
+}
+
+func checkScan(t *testing.T, pairs []KeyValue, from int, to int) {
+  if len(pairs) != to - from {
+    t.Fatalf("scan returned %d keys, wanted %d", len(pairs), to - from)
+  }
+  for i, kv := range pairs {
+    if kv.Key != fmt.Sprintf("k%03d", from + i) || kv.Value != fmt.Sprintf("v%d", from + i) {
+      t.Fatalf("scan returned %s=%s at %d, wanted k%03d=v%d", kv.Key, kv.Value, i, from + i, from + i)
+    }
+  }
+}
+
+func TestScan(t *testing.T) {
+  config := viewservice.DefaultConfig()
+  c, ck := startCluster(t, config, config.CriticalMass + 1)
+
+  fmt.Printf("Test: Scans are ordered across shards ...\n")
+
+  if PrefixEnd("k1") != "k2" || PrefixEnd("a\xff") != "b" || PrefixEnd("\xff") != "" {
+    t.Fatalf("PrefixEnd is wrong")
+  }
+
+  nkeys := 200
+  for i:=0; i < nkeys; i++ {
+    ck.Put(fmt.Sprintf("k%03d", i), fmt.Sprintf("v%d", i))
+  }
+  ck.Put("other", "x")
+
+  checkScan(t, scanAll(ck, "k", "l", 1000), 0, nkeys)
+  checkScan(t, scanAll(ck, "k", "l", 7), 0, nkeys)
+  checkScan(t, scanAll(ck, "k050", "k150", 10), 50, 150)
+
+  pairs, next := ck.Scan("", "", 5)
+  checkScan(t, pairs, 0, 5)
+  if next != "k004\x00" {
+    t.Fatalf("scan of 5 keys continues at %q", next)
+  }
+  if len(scanAll(ck, "", "", 30)) != nkeys + 1 {
+    t.Fatalf("unbounded scan didn't return every key")
+  }
+
+  pairs, next = ck.ScanPrefix("k19", 100)
+  checkScan(t, pairs, 190, 200)
+  if next != "" {
+    t.Fatalf("whole prefix scan continues at %q", next)
+  }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Scans follow splits and moves ...\n")
+
+  shard := ck.WhichShard("k000")
+  child, err := ck.SplitShard(shard, "")
+  if err != viewservice.OK {
+    t.Fatalf("SplitShard failed: %v", err)
+  }
+  from := ck.GetView().ShardsToPrimaries[child]
+  to   := c.servers[0].me
+  if from == to {
+    to = c.servers[1].me
+  }
+
+  // the primary may not have heard about the split yet
+  err = ck.MoveShard(child, to)
+  for iters := 0; iters < 10 && err == viewservice.ErrMoveFailed; iters++ {
+    time.Sleep(viewservice.PING_INTERVAL)
+    err = ck.MoveShard(child, to)
+  }
+  if err != viewservice.OK {
+    t.Fatalf("MoveShard failed: %v", err)
+  }
+
+  checkScan(t, scanAll(ck, "k", "l", 9), 0, nkeys)
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Scans wait for shards without a primary ...\n")
+
+  // as if child's primary had just died
+  ck.updateView()
+  delete(ck.view.ShardsToPrimaries, child)
+  if _, _, ok := ck.scanView("k", "l", 1000); ok {
+    t.Fatalf("scan missing shard %d was taken as complete", child)
+  }
+  checkScan(t, scanAll(ck, "k", "l", 1000), 0, nkeys)
+  fmt.Printf("  ... Passed\n")
+
+  c.kill()
+}
+
+func TestDelete(t *testing.T) {
+  config := viewservice.DefaultConfig()
+  c, ck := startCluster(t, config, config.CriticalMass + 1)
+
+  fmt.Printf("Test: Deleted keys are gone ...\n")
+
+  nkeys := 50
+  for i:=0; i < nkeys; i++ {
+    ck.Put(fmt.Sprintf("k%03d", i), fmt.Sprintf("v%d", i))
+  }
+  for i:=0; i < nkeys; i += 2 {
+    ck.Delete(fmt.Sprintf("k%03d", i))
+  }
+  // deleted and put back
+  ck.Delete("k001")
+  ck.Put("k001", "again")
+  // deleting what isn't there is fine
+  ck.Delete("nothing")
+
+  check := func() {
+    for i:=0; i < nkeys; i++ {
+      key := fmt.Sprintf("k%03d", i)
+      wanted := fmt.Sprintf("v%d", i)
+      if i % 2 == 0 {
+        wanted = ""
+      } else if i == 1 {
+        wanted = "again"
+      }
+      if v := ck.Get(key); v != wanted {
+        t.Fatalf("Get(%s) = %v, wanted %v", key, v, wanted)
+      }
+    }
+    if pairs := scanAll(ck, "k", "l", 10); len(pairs) != nkeys / 2 {
+      t.Fatalf("scan returned %d keys, wanted %d", len(pairs), nkeys / 2)
+    }
+  }
+  check()
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Deletes survive recovery ...\n")
+
+  shard := ck.WhichShard("k000")
+  victim := c.byName[ck.GetView().ShardsToPrimaries[shard]]
+  victim.kill()
+
+  if ! awaitRecovery(ck, victim, shard) {
+    t.Fatalf("%v was never recovered", victim.me)
+  }
+
+  check()
+  fmt.Printf("  ... Passed\n")
+
+  c.kill()
+}
+
+func TestConditionalPut(t *testing.T) {
+  config := viewservice.DefaultConfig()
+  c, ck := startCluster(t, config, config.CriticalMass + 1)
+
+  fmt.Printf("Test: Conditional puts check the version ...\n")
+
+  if _, version, err := ck.GetWithVersion("c"); err != ErrNoKey || version != 0 {
+    t.Fatalf("version of a new key is %d", version)
+  }
+  if version, err := ck.ConditionalPut("c", "x", 1); err != ErrVersionMismatch || version != 0 {
+    t.Fatalf("ConditionalPut at the wrong version = %d, %v", version, err)
+  }
+  if version, err := ck.ConditionalPut("c", "0", 0); err != OK || version != 1 {
+    t.Fatalf("ConditionalPut of a new key = %d, %v", version, err)
+  }
+  ck.Put("c", "1")
+  if value, version, _ := ck.GetWithVersion("c"); value != "1" || version != 2 {
+    t.Fatalf("GetWithVersion(c) = %v, %d; wanted 1, 2", value, version)
+  }
+  ck.Delete("c")
+  if _, err := ck.ConditionalPut("c", "x", 2); err != ErrVersionMismatch {
+    t.Fatalf("ConditionalPut over a delete returned %v", err)
+  }
+  if _, version, err := ck.GetWithVersion("c"); err != ErrNoKey || version != 3 {
+    t.Fatalf("version of a deleted key is %d, wanted 3", version)
+  }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Concurrent counter ...\n")
+
+  nclients := 3
+  nincrs := 10
+  done := make(chan bool)
+  for i:=0; i < nclients; i++ {
+    myck := c.clerk()
+    go func() {
+      for n := 0; n < nincrs; {
+        value, version, err := myck.GetWithVersion("counter")
+        if err != OK && err != ErrNoKey {
+          continue
+        }
+        count, _ := strconv.Atoi(value)
+        _, err = myck.ConditionalPut("counter", strconv.Itoa(count + 1), version)
+        if err == OK {
+          n++
+        }
+      }
+      done <- true
+    }()
+  }
+  for i:=0; i < nclients; i++ {
+    <-done
+  }
+
+  value, version, _ := ck.GetWithVersion("counter")
+  if value != strconv.Itoa(nclients * nincrs) || version != int64(nclients * nincrs) {
+    t.Fatalf("counter = %v at version %d; wanted %d", value, version, nclients * nincrs)
+  }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Versions survive recovery ...\n")
+
+  shard := ck.WhichShard("counter")
+  victim := c.byName[ck.GetView().ShardsToPrimaries[shard]]
+  victim.kill()
+
+  if ! awaitRecovery(ck, victim, shard) {
+    t.Fatalf("%v was never recovered", victim.me)
+  }
+
+  if v, ver, _ := ck.GetWithVersion("counter"); v != value || ver != version {
+    t.Fatalf("after recovery counter = %v at version %d; wanted %v at %d", v, ver, value, version)
+  }
+  if _, err := ck.ConditionalPut("counter", "stale", version - 1); err != ErrVersionMismatch {
+    t.Fatalf("ConditionalPut at an old version returned %v after recovery", err)
+  }
+  if ver, err := ck.ConditionalPut("counter", "next", version); err != OK || ver != version + 1 {
+    t.Fatalf("ConditionalPut after recovery = %d, %v", ver, err)
+  }
+  fmt.Printf("  ... Passed\n")
+
+  c.kill()
+}
+
+func TestExactlyOnce(t *testing.T) {
+  config := viewservice.DefaultConfig()
+  c, ck := startCluster(t, config, config.CriticalMass + 1)
+  ck2 := c.clerk()
+
+  fmt.Printf("Test: Retried requests are applied once ...\n")
+
+  if ck.ClientID == 0 || ck.ClientID == ck2.ClientID {
+    t.Fatalf("clerks got client ids %d and %d", ck.ClientID, ck2.ClientID)
+  }
+
+  // a put whose reply was lost, sent again after someone else's put
+  primary := ck.GetView().ShardsToPrimaries[ck.WhichShard("x")]
+  ck.RequestID++
+  args := PutArgs{Key: "x", Value: "mine", Client: ck.ClientID, Request: ck.RequestID}
+  var reply PutReply
+  if ! call(primary, "PBServer.Put", c.mode, args, &reply) || reply.Err != OK {
+    t.Fatalf("Put failed: %v", reply.Err)
+  }
+  ck2.Put("x", "theirs")
+  if ! call(primary, "PBServer.Put", c.mode, args, &reply) || reply.Err != OK {
+    t.Fatalf("retried Put failed: %v", reply.Err)
+  }
+  if value, version, _ := ck.GetWithVersion("x"); value != "theirs" || version != 2 {
+    t.Fatalf("GetWithVersion(x) = %v, %d; wanted theirs, 2", value, version)
+  }
+
+  ck.RequestID++
+  casArgs := ConditionalPutArgs{Key: "x", Value: "cas", Version: 2, Client: ck.ClientID, Request: ck.RequestID}
+  var casReply ConditionalPutReply
+  for i := 0; i < 2; i++ {
+    if ! call(primary, "PBServer.ConditionalPut", c.mode, casArgs, &casReply) ||
+       casReply.Err != OK || casReply.Version != 3 {
+      t.Fatalf("ConditionalPut = %d, %v; wanted 3, OK", casReply.Version, casReply.Err)
+    }
+  }
+  if value, version, _ := ck.GetWithVersion("x"); value != "cas" || version != 3 {
+    t.Fatalf("GetWithVersion(x) = %v, %d; wanted cas, 3", value, version)
+  }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Retries stay idempotent across recovery ...\n")
+
+  ck2.Put("x", "later")
+
+  victim := c.byName[primary]
+  victim.kill()
+
+  shard := ck.WhichShard("x")
+  if ! awaitRecovery(ck, victim, shard) {
+    t.Fatalf("%v was never recovered", victim.me)
+  }
+
+  primary = ck.GetView().ShardsToPrimaries[shard]
+  if ! call(primary, "PBServer.ConditionalPut", c.mode, casArgs, &casReply) || casReply.Err != OK {
+    t.Fatalf("retried ConditionalPut failed after recovery: %v", casReply.Err)
+  }
+  // overwritten, and superseded by the conditional put
+  reply = PutReply{}
+  if ! call(primary, "PBServer.Put", c.mode, args, &reply) || reply.Err != ErrDuplicate {
+    t.Fatalf("retried Put after recovery = %v, wanted %v", reply.Err, ErrDuplicate)
+  }
+  if value, version, _ := ck.GetWithVersion("x"); value != "later" || version != 4 {
+    t.Fatalf("GetWithVersion(x) = %v, %d; wanted later, 4", value, version)
+  }
+
+  // a retry isn't answered with the version of the client's latest key
+  z := ""
+  for i := 0; z == ""; i++ {
+    if key := fmt.Sprintf("z%d", i); ck.WhichShard(key) == shard {
+      z = key
+    }
+  }
+  ck.Put(z, "z")
+  casReply = ConditionalPutReply{}
+  if ! call(primary, "PBServer.ConditionalPut", c.mode, casArgs, &casReply) ||
+     casReply.Err != ErrDuplicate || casReply.Version != 0 {
+    t.Fatalf("ConditionalPut retried after a put of %v = %d, %v; wanted 0, %v", z, casReply.Version, casReply.Err, ErrDuplicate)
+  }
+  if value, version, _ := ck.GetWithVersion("x"); value != "later" || version != 4 {
+    t.Fatalf("GetWithVersion(x) = %v, %d; wanted later, 4", value, version)
+  }
+
+  // new requests still go through
+  ck.Put("x", "new")
+  if value := ck.Get("x"); value != "new" {
+    t.Fatalf("Get(x) = %v, wanted new", value)
+  }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Retries stay idempotent across a move ...\n")
+
+  // a put whose reply was lost, overwritten before its shard moves
+  shard = ck.WhichShard("y")
+  primary = ck.GetView().ShardsToPrimaries[shard]
+  ck.RequestID++
+  args = PutArgs{Key: "y", Value: "mine", Client: ck.ClientID, Request: ck.RequestID}
+  if ! call(primary, "PBServer.Put", c.mode, args, &reply) || reply.Err != OK {
+    t.Fatalf("Put failed: %v", reply.Err)
+  }
+  ck2.Put("y", "theirs")
+
+  to := ""
+  for name, server := range c.byName {
+    if name != primary && server != victim {
+      to = name
+    }
+  }
+  err := ck.MoveShard(shard, to)
+  for iters := 0; iters < 10 && err == viewservice.ErrMoveFailed; iters++ {
+    time.Sleep(viewservice.PING_INTERVAL)
+    err = ck.MoveShard(shard, to)
+  }
+  if err != viewservice.OK {
+    t.Fatalf("MoveShard failed: %v", err)
+  }
+
+  // the new primary may not have heard about the move yet
+  ok := call(to, "PBServer.Put", c.mode, args, &reply)
+  for iters := 0; iters < 10 && ok && reply.Err == ErrWrongServer; iters++ {
+    time.Sleep(viewservice.PING_INTERVAL)
+    ok = call(to, "PBServer.Put", c.mode, args, &reply)
+  }
+  if ! ok || reply.Err != OK {
+    t.Fatalf("retried Put failed after the move: %v", reply.Err)
+  }
+  if value := ck.Get("y"); value != "theirs" {
+    t.Fatalf("Get(y) = %v, wanted theirs", value)
+  }
+  fmt.Printf("  ... Passed\n")
+
+  c.kill()
+}
+
+func TestMultiPut(t *testing.T) {
+  config := viewservice.DefaultConfig()
+  c, ck := startCluster(t, config, config.CriticalMass + 1)
+
+  fmt.Printf("Test: Batches of puts and gets ...\n")
+
+  nkeys := 100
+  pairs := make([]KeyValue, 0)
+  keys  := make([]string, 0)
+  for i:=0; i < nkeys; i++ {
+    pairs = append(pairs, KeyValue{Key: fmt.Sprintf("k%03d", i), Value: fmt.Sprintf("v%d", i)})
+    keys  = append(keys, fmt.Sprintf("k%03d", i))
+  }
+  // a key put twice in a batch ends up with the later value
+  pairs = append(pairs, KeyValue{Key: "k000", Value: "last"})
+
+  for i, err := range ck.MultiPut(pairs) {
+    if err != OK {
+      t.Fatalf("MultiPut of %s failed: %v", pairs[i].Key, err)
+    }
+  }
+
+  values, errs := ck.MultiGet(append(keys, "missing"))
+  for i:=0; i < nkeys; i++ {
+    wanted := fmt.Sprintf("v%d", i)
+    if i == 0 {
+      wanted = "last"
+    }
+    if errs[i] != OK || values[i] != wanted {
+      t.Fatalf("MultiGet of %s = %v, %v; wanted %v", keys[i], values[i], errs[i], wanted)
+    }
+  }
+  if errs[nkeys] != ErrNoKey {
+    t.Fatalf("MultiGet of a missing key returned %v", errs[nkeys])
+  }
+  if value, version, _ := ck.GetWithVersion("k000"); value != "last" || version != 2 {
+    t.Fatalf("GetWithVersion(k000) = %v, %d; wanted last, 2", value, version)
+  }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Errors are per key ...\n")
+
+  view := ck.GetView()
+  mine, other := "", ""
+  primary := view.ShardsToPrimaries[ck.WhichShard("k001")]
+  for _, key := range keys {
+    if view.ShardsToPrimaries[ck.WhichShard(key)] == primary {
+      mine = key
+    } else {
+      other = key
+    }
+  }
+  if mine == "" || other == "" {
+    t.Fatalf("all keys are with one primary")
+  }
+
+  // the batch stops at the first key the primary doesn't serve
+  ck.RequestID += 3
+  args := MultiPutArgs{Puts: []PutArgs{
+    PutArgs{Key: mine, Value: "a", Client: ck.ClientID, Request: ck.RequestID - 2},
+    PutArgs{Key: other, Value: "b", Client: ck.ClientID, Request: ck.RequestID - 1},
+    PutArgs{Key: mine, Value: "c", Client: ck.ClientID, Request: ck.RequestID},
+  }}
+  var reply MultiPutReply
+  if ! call(primary, "PBServer.MultiPut", c.mode, args, &reply) {
+    t.Fatalf("MultiPut RPC failed")
+  }
+  if reply.Errs[0] != OK || reply.Errs[1] != ErrWrongServer || reply.Errs[2] != ErrWrongServer {
+    t.Fatalf("MultiPut errors = %v", reply.Errs)
+  }
+
+  // sent again, what made it is only applied once
+  _, version, _ := ck.GetWithVersion(mine)
+  reply = MultiPutReply{}
+  call(primary, "PBServer.MultiPut", c.mode, MultiPutArgs{Puts: args.Puts[:1]}, &reply)
+  if v, ver, _ := ck.GetWithVersion(mine); v != "a" || ver != version {
+    t.Fatalf("retried MultiPut left %s = %v at %d; wanted a at %d", mine, v, ver, version)
+  }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: A lost batch isn't taken for a duplicate of a later one ...\n")
+
+  // mine moves to the primary of other, but the clerk still sends it to a
+  // primary that never answers
+  moved := ck.WhichShard(mine)
+  to := view.ShardsToPrimaries[ck.WhichShard(other)]
+  if err := ck.MoveShard(moved, to); err != viewservice.OK {
+    t.Fatalf("MoveShard failed: %v", err)
+  }
+  ck.updateView()
+  ck.view.ShardsToPrimaries[moved] = c.host()
+
+  for i, err := range ck.MultiPut([]KeyValue{KeyValue{Key: mine, Value: "lost"}, KeyValue{Key: other, Value: "later"}}) {
+    if err != OK {
+      t.Fatalf("MultiPut %d failed: %v", i, err)
+    }
+  }
+  if v := ck.Get(mine); v != "lost" {
+    t.Fatalf("%s = %v after its batch was sent again; wanted lost", mine, v)
+  }
+  if v := ck.Get(other); v != "later" {
+    t.Fatalf("%s = %v; wanted later", other, v)
+  }
+  fmt.Printf("  ... Passed\n")
+
+  c.kill()
+}
+
+func TestGroupCommit(t *testing.T) {
+  config := viewservice.DefaultConfig()
+  c, ck := startCluster(t, config, config.CriticalMass + 1)
+
+  fmt.Printf("Test: Reads don't wait on replication ...\n")
+
+  ck.Put("a", "1")
+  primary := c.byName[ck.GetView().ShardsToPrimaries[ck.WhichShard("a")]]
+
+  // the backups take the first writes but don't answer
+  for _, server := range c.servers {
+    if server != primary {
+      server.backupMu.Lock()
+    }
+  }
+  unblock := func() {
+    for _, server := range c.servers {
+      if server != primary {
+        server.backupMu.Unlock()
+      }
+    }
+  }
+
+  nclients := 10
+  done := make(chan bool, nclients)
+  for i:=0; i < nclients; i++ {
+    myck := c.clerk()
+    go func(i int) {
+      myck.Put("a", strconv.Itoa(i))
+      done <- true
+    }(i)
+  }
+
+  // wait for the rest to queue up behind the first
+  queued := 0
+  for iters := 0; iters < 100 && queued < nclients - 1; iters++ {
+    time.Sleep(10 * time.Millisecond)
+    primary.mu.Lock()
+    queued = len(primary.queue)
+    primary.mu.Unlock()
+  }
+  if queued == 0 || len(done) > 0 {
+    unblock()
+    t.Fatalf("%d puts queued and %d done while the backups were stuck", queued, len(done))
+  }
+
+  reader := make(chan string)
+  go func() {
+    reader <- ck.Get("a")
+  }()
+  select {
+  case v := <-reader:
+    if v != "1" {
+      unblock()
+      t.Fatalf("Get(a) = %v before the puts were committed", v)
+    }
+  case <-time.After(viewservice.PING_INTERVAL):
+    unblock()
+    t.Fatalf("Get waited for replication")
+  }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Queued writes are committed together ...\n")
+
+  unblock()
+  for i:=0; i < nclients; i++ {
+    <-done
+  }
+
+  primary.mu.Lock()
+  queued = len(primary.queue)
+  primary.mu.Unlock()
+  if queued != 0 {
+    t.Fatalf("%d puts left in the queue", queued)
+  }
+  if _, version, _ := ck.GetWithVersion("a"); version != int64(nclients + 1) {
+    t.Fatalf("version of a is %d, wanted %d", version, nclients + 1)
+  }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Many concurrent clients ...\n")
+
+  nputs := 20
+  for i:=0; i < nclients; i++ {
+    myck := c.clerk()
+    go func(i int) {
+      for j:=0; j < nputs; j++ {
+        myck.Put(fmt.Sprintf("c%d-%d", i, j), fmt.Sprintf("v%d", j))
+      }
+      done <- true
+    }(i)
+  }
+  for i:=0; i < nclients; i++ {
+    <-done
+  }
+
+  for i:=0; i < nclients; i++ {
+    for j:=0; j < nputs; j++ {
+      if v := ck.Get(fmt.Sprintf("c%d-%d", i, j)); v != fmt.Sprintf("v%d", j) {
+        t.Fatalf("Get(c%d-%d) = %v, wanted v%d", i, j, v, j)
+      }
+    }
+  }
+  fmt.Printf("  ... Passed\n")
+
+  c.kill()
+}
+
 func printStats(samples []int64) {
   var sum int64 = 0
   var min int64 = 1<<63 - 1
@@ -3,22 +3,38 @@ package viewservice
 
 import "net/rpc"
 import "fmt"
+import "reflect"
+import "strings"
+import "sync"
+import "time"
 
 
 type Clerk struct {
+  mu sync.Mutex
   me string      // client's name (host:port)
-  server string  // viewservice's host:port
+  servers []string  // host:port of each viewservice replica
+  leader int     // replica that answered last
   view View
+  draining map[string]bool   // as of the last ping
+  incarnation int64   // sent with pings, for servers that restart
+  leaseExpiry time.Time   // when the lease from the last ping runs out
+  domain string       // sent with pings
+  configDigest string // sent with pings
+  pingInterval time.Duration  // how long to back off when no replica answers
+  domains map[string]string   // as of the last ping
   networkMode string
 }
 
 
+// server is the viewservice's host:port, or a comma-separated list of
+// replicas' host:ports when the viewservice is replicated.
 func MakeClerk(me string, server string, networkMode string) *Clerk {
   ck := new(Clerk)
   ck.me = me
-  ck.server = server
+  ck.servers = strings.Split(server, ",")
   ck.view = View{}
   ck.networkMode = networkMode
+  ck.pingInterval = PING_INTERVAL
   return ck
 }
 
@@ -38,33 +54,188 @@ func call(srv string, rpcname string, networkMode string, args interface{}, repl
 }
 
 
+// sends an RPC to the replica that answered last, failing over to the
+// others in turn.
+func (ck *Clerk) callAny(rpcname string, args interface{}, reply interface{}) bool {
+  ck.mu.Lock()
+  leader := ck.leader
+  ck.mu.Unlock()
+
+  for i := 0; i < len(ck.servers); i++ {
+    idx := (leader + i) % len(ck.servers)
+    if call(ck.servers[idx], rpcname, ck.networkMode, args, reply) {
+      ck.mu.Lock()
+      ck.leader = idx
+      ck.mu.Unlock()
+      return true
+    }
+  }
+  return false
+}
+
+
+// sends an RPC that only the leading replica answers, moving on to the next
+// replica each time one says it isn't leading. reply must point to a struct
+// with an Err field; returns that Err, or ErrNotLeader if no replica took
+// the call.
+func (ck *Clerk) callLeader(rpcname string, args interface{}, reply interface{}) Err {
+  v := reflect.ValueOf(reply).Elem()
+
+  for i := 0; i < len(ck.servers); i++ {
+    v.Set(reflect.Zero(v.Type()))
+    ok := ck.callAny(rpcname, args, reply)
+    if ! ok {
+      break
+    }
+    err := Err(v.FieldByName("Err").String())
+    if err != ErrNotLeader {
+      return err
+    }
+
+    // try the next one
+    ck.mu.Lock()
+    ck.leader = (ck.leader + 1) % len(ck.servers)
+    ck.mu.Unlock()
+  }
+
+  v.Set(reflect.Zero(v.Type()))
+  return ErrNotLeader
+}
+
+
+// marks pings as coming from a particular run of the server, so that the
+// viewservice notices when it restarts.
+func (ck *Clerk) SetIncarnation(incarnation int64) {
+  ck.incarnation = incarnation
+}
+
+
+// has pings say which config the server runs with, so that the viewservice
+// can turn it away if that isn't the cluster's, and backs off for the
+// config's ping interval rather than the default one.
+func (ck *Clerk) SetConfig(config Config) {
+  ck.configDigest = config.Digest()
+  ck.pingInterval = config.PingInterval
+}
+
+
+// how long the clerk backs off when no replica answers.
+func (ck *Clerk) PingInterval() time.Duration {
+  return ck.pingInterval
+}
+
+
+// tells the viewservice which failure domain the server is in, so that it
+// doesn't put too many eggs in one basket.
+func (ck *Clerk) SetDomain(domain string) {
+  ck.domain = domain
+}
+
+
 func (ck *Clerk) GetServerName() string {
-  return ck.server
+  return strings.Join(ck.servers, ",")
 }
 
 
 func (ck *Clerk) Ping(viewnum uint) (View, map[string]bool, error) {
+  return ck.PingWithLoad(viewnum, ServerLoad{})
+}
+
+
+// pings every replica, so that whichever one is leading knows we're alive
+// and how busy we are. replies with the most recent view any of them knows
+// about.
+func (ck *Clerk) PingWithLoad(viewnum uint, load ServerLoad) (View, map[string]bool, error) {
   // prepare the arguments.
   args := &PingArgs{}
   args.ServerName = ck.me
-  var reply PingReply
+  args.Load = load
+  args.Incarnation = ck.incarnation
+  args.Domain = ck.domain
+  args.ConfigDigest = ck.configDigest
+
+  replies := make([]*PingReply, len(ck.servers))
+  acks    := make([]bool, len(ck.servers))
+
+  // a lease counts from when we asked for it, not from when it arrived
+  start := time.Now()
 
   // send an RPC request, wait for the reply.
-  ok := call(ck.server, "ViewServer.Ping", ck.networkMode, args, &reply)
-  if ok == false {
+  var wg sync.WaitGroup
+  for idx, server := range ck.servers {
+    wg.Add(1)
+    go func(idx int, server string) {
+      reply := new(PingReply)
+      acks[idx] = call(server, "ViewServer.Ping", ck.networkMode, args, reply)
+      replies[idx] = reply
+      wg.Done()
+    }(idx, server)
+  }
+  wg.Wait()
+
+  var reply *PingReply
+  var lease time.Duration
+  misconfigured := false
+  for idx, ack := range acks {
+    if ack && replies[idx].Err == ErrBadConfig {
+      misconfigured = true
+      continue
+    }
+    if ack && (reply == nil || replies[idx].View.ViewNumber > reply.View.ViewNumber) {
+      reply = replies[idx]
+    }
+    if ack && replies[idx].Lease > lease {
+      lease = replies[idx].Lease
+    }
+  }
+
+  if reply == nil {
     ck.view = View{}
+    if misconfigured {
+      return View{}, make(map[string]bool), fmt.Errorf("Ping(%v): %v", viewnum, ErrBadConfig)
+    }
     return View{}, make(map[string]bool), fmt.Errorf("Ping(%v) failed", viewnum)
   }
 
   ck.view = reply.View
+  ck.draining = reply.Draining
+  ck.domains = reply.Domains
+  if lease > 0 {
+    ck.leaseExpiry = start.Add(lease)
+  }
   return reply.View, reply.ServersAlive, nil
 }
 
 
+// servers that are being drained, as of the last ping. primaries shouldn't
+// pick them as backups.
+func (ck *Clerk) Draining() map[string]bool {
+  if ck.draining == nil {
+    return make(map[string]bool)
+  }
+  return ck.draining
+}
+
+
+// failure domains of the servers that declared one, as of the last ping.
+func (ck *Clerk) Domains() map[string]string {
+  if ck.domains == nil {
+    return make(map[string]string)
+  }
+  return ck.domains
+}
+
+
+// until when we may act as a primary, as of the last ping.
+func (ck *Clerk) LeaseExpiry() time.Time {
+  return ck.leaseExpiry
+}
+
+
 func (ck *Clerk) Get() (View, bool) {
   args := &GetArgs{}
   var reply GetReply
-  ok := call(ck.server, "ViewServer.Get", ck.networkMode, args, &reply)
+  ok := ck.callAny("ViewServer.Get", args, &reply)
 
   if ok == false {
     return View{}, false
@@ -72,14 +243,62 @@ func (ck *Clerk) Get() (View, bool) {
   return reply.View, true
 }
 
+// waits up to timeout (at most WATCH_TIMEOUT) for a view newer than viewnum.
+// returns false if no replica could be reached; the view is unchanged if none
+// came along in time.
+func (ck *Clerk) WatchView(viewnum uint, timeout time.Duration) (View, map[string]bool, bool) {
+  args  := &WatchViewArgs{ViewNumber: viewnum, Timeout: timeout}
+  reply := &WatchViewReply{}
+  ok := ck.callAny("ViewServer.WatchView", args, reply)
+
+  if ok == false {
+    return View{}, make(map[string]bool), false
+  }
+  return reply.View, reply.ServersAlive, true
+}
+
+
+// calls handler with the latest view each time one newer than viewnum comes
+// along, until it returns false or done does. runs in the background; done
+// is checked between every wait for a view, so it is heard within
+// WATCH_TIMEOUT even while there are no new views or no viewservice.
+func (ck *Clerk) Subscribe(viewnum uint, done func() bool, handler func(View, map[string]bool) bool) {
+  go func() {
+    for ! done() {
+      view, serversAlive, ok := ck.WatchView(viewnum, WATCH_TIMEOUT)
+      if ! ok {
+        time.Sleep(ck.pingInterval)
+        continue
+      }
+      if view.ViewNumber <= viewnum {
+        continue
+      }
+      viewnum = view.ViewNumber
+      if ! handler(view, serversAlive) {
+        return
+      }
+    }
+  }()
+}
+
+
 func (ck *Clerk) Status() StatusReply {
   args  := &StatusArgs{}
   reply := &StatusReply{}
-  call(ck.server, "ViewServer.Status", ck.networkMode, args, reply)
+  ck.callAny("ViewServer.Status", args, reply)
   return *reply
 }
 
 
+// cluster events after the one numbered since, oldest first
+func (ck *Clerk) Events(since int) []Event {
+  args  := &EventsArgs{Since: since}
+  reply := &EventsReply{}
+  ck.callAny("ViewServer.Events", args, reply)
+  return reply.Events
+}
+
+
 func (ck *Clerk) RecoveryCompleted(me string, shard int, size int) bool {
   args  := RecoveryCompletedArgs{}
   args.ServerName = me
@@ -87,13 +306,51 @@ func (ck *Clerk) RecoveryCompleted(me string, shard int, size int) bool {
   args.DataRecieved = size
   reply := &RecoveryCompletedReply{}
 
-  ok := call(ck.server, "ViewServer.RecoveryCompleted", ck.networkMode, args, &reply)
-
   // TODO: make sure that recovered primary is correct primary
-  if ok == false {
-    return false
-  }
+  return ck.callLeader("ViewServer.RecoveryCompleted", args, reply) == OK
+}
+
 
-  return true
+// tells the leading replica how recovery of shard is going
+func (ck *Clerk) RecoveryProgress(args RecoveryProgressArgs) {
+  reply := &RecoveryProgressReply{}
+  ck.callLeader("ViewServer.RecoveryProgress", args, reply)
 }
 
+
+// asks the viewservice to move shard to a new primary. the leading replica
+// is the only one that can do it.
+func (ck *Clerk) MoveShard(shard int, destination string) Err {
+  args  := &MoveShardArgs{Shard: shard, Destination: destination}
+  reply := &MoveShardReply{}
+  return ck.callLeader("ViewServer.MoveShard", args, reply)
+}
+
+
+// asks the viewservice to split shard in two, at key if shards hold ranges
+// of keys and it isn't "". returns the new half.
+func (ck *Clerk) SplitShard(shard int, key string) (int, Err) {
+  args  := &SplitShardArgs{Shard: shard, Key: key}
+  reply := &SplitShardReply{}
+  err := ck.callLeader("ViewServer.SplitShard", args, reply)
+  return reply.Shard, err
+}
+
+
+// asks the viewservice to merge shard back with its other half. returns
+// the merged shard.
+func (ck *Clerk) MergeShards(shard int) (int, Err) {
+  args  := &MergeShardsArgs{Shard: shard}
+  reply := &MergeShardsReply{}
+  err := ck.callLeader("ViewServer.MergeShards", args, reply)
+  return reply.Shard, err
+}
+
+
+// asks the viewservice to take server out of service once its shards and
+// backups have been moved elsewhere.
+func (ck *Clerk) Drain(server string) Err {
+  args  := &DrainArgs{Server: server}
+  reply := &DrainReply{}
+  return ck.callLeader("ViewServer.Drain", args, reply)
+}
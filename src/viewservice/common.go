@@ -4,25 +4,84 @@ package viewservice
 import "time"
 
 
+// defaults for a cluster's Config
 const PING_INTERVAL = time.Millisecond * 100
 const DEAD_PINGS = 12
 const REPLICATION_LEVEL = 2
 const CRITICAL_MASS = 10
 const NUMBER_OF_SHARDS = 100
 
+// how long a recovery master may go without finishing a shard before its
+// shards are given to somebody else
+const RECOVERY_TIMEOUT = 30 * time.Second
+
+// how many finished recoveries Status keeps reporting
+const RECOVERIES_KEPT = 10
+
+// Config.LeaseTime of the default config
+const LEASE_TIME = PING_INTERVAL * DEAD_PINGS / 2
+
+// longest a WatchView call waits for a new view before replying anyway
+const WATCH_TIMEOUT = 2 * time.Second
+
+// how long a replica waits for the others to agree on a journal entry
+const COMMIT_TIMEOUT = 2 * time.Second
+
+const (
+  OK = "OK"
+  ErrNotLeader = "ErrNotLeader"
+  ErrUnknownShard = "ErrUnknownShard"
+  ErrNotAlive = "ErrNotAlive"
+  ErrBusy = "ErrBusy"
+  ErrMoveFailed = "ErrMoveFailed"
+  ErrTooFewServers = "ErrTooFewServers"
+  ErrBadConfig = "ErrBadConfig"
+  ErrTooManySplits = "ErrTooManySplits"
+  ErrNotSplit = "ErrNotSplit"
+  ErrNotColocated = "ErrNotColocated"
+  ErrBadKey = "ErrBadKey"
+  ErrNoMajority = "ErrNoMajority"
+)
+
+type Err string
+
 type View struct {
   ViewNumber uint
+  NumberOfShards int                   // keys are spread over this many shards, before splits
   ShardsToPrimaries map[int] string    // shard #{shard index} -> primary
+  Splits map[int] uint                 // times each shard has been split; not listed if never
+  Ranges map[int] KeyRange             // keys each shard holds, if shards hold ranges of keys
+}
+
+// keys from Start up to but not including End. an empty End has no bound.
+type KeyRange struct {
+  Start string
+  End string
 }
 
 type PingArgs struct {
   ServerName string
   ViewNumber uint
+  Load ServerLoad
+  Incarnation int64     // changes every time the server starts; 0 if it doesn't say
+  Domain string         // failure domain (rack, zone, machine) it runs in; "" if it doesn't say
+  ConfigDigest string   // of the server's Config; "" if it doesn't say
+}
+
+// how busy a server is, as reported in its pings
+type ServerLoad struct {
+  StoreBytes int64          // memory used by the server's store
+  BackedUpSegments int      // log segments it holds as a backup
+  Capacity int64            // memory it has for its store; 0 if it doesn't say
 }
 
 type PingReply struct {
   View View
   ServersAlive map[string] bool      // set of servers primaries can choose as backups
+  Draining map[string] bool          // except these, which are on their way out
+  Lease time.Duration                // how long the sender may act as primary; 0 for none
+  Domains map[string] string         // failure domain of each server that declared one
+  Err Err                            // ErrBadConfig if the sender isn't configured like us
 }
 
 type GetArgs struct {
@@ -32,6 +91,17 @@ type GetReply struct {
   View View
 }
 
+type WatchViewArgs struct {
+  ViewNumber uint     // reply once there is a view newer than this one
+  Timeout time.Duration   // or once this long has passed; at most WATCH_TIMEOUT
+}
+
+type WatchViewReply struct {
+  View View
+  ServersAlive map[string]bool
+  Changed bool        // false if the timeout ran out first
+}
+
 type RecoveryCompletedArgs struct {
   ServerName string
   ShardRecovered int
@@ -39,7 +109,32 @@ type RecoveryCompletedArgs struct {
 }
 
 type RecoveryCompletedReply struct {
+  Err Err
+}
 
+// sent by recovery masters as they fetch and replay segments
+type RecoveryProgressArgs struct {
+  ServerName string      // recovery master
+  Shard int
+  SegmentsNeeded int
+  SegmentsFetched int
+  BytesReplayed int64
+}
+
+type RecoveryProgressReply struct {
+  Err Err
+}
+
+// how recovery of a single shard is going
+type ShardRecovery struct {
+  RecoveryMaster string
+  SegmentsNeeded int
+  SegmentsFetched int
+  BytesReplayed int64
+  Started time.Time
+  Elapsed time.Duration
+  ETA time.Duration       // estimated time left; 0 if done or nothing fetched yet
+  Done bool
 }
 
 type StatusArgs struct {
@@ -52,6 +147,77 @@ type StatusReply struct {
   PrimaryServers    map[string] bool
   RecoveryInProcess map[string][]int
   RecoveryMasters   map[string]map[int]bool
+  Migrations        map[int]string     // shard -> new primary, for handoffs in progress
+  ServerLoads       map[string] ServerLoad
+  LostSegments      map[string][]int64   // dead server -> log segments no live backup has
+  Draining          map[string] bool
+  Decommissioned    map[string] bool
+  Recoveries        map[string]map[int]ShardRecovery   // dead server -> shard -> progress
+  Domains           map[string] string
+}
+
+
+// MoveShard
+
+type MoveShardArgs struct {
+  Shard int
+  Destination string
+}
+
+type MoveShardReply struct {
+  Err Err
+}
+
+
+// SplitShard, MergeShards
+
+type SplitShardArgs struct {
+  Shard int
+  Key string      // first key of the new half of a range; "" for about the middle
+}
+
+type SplitShardReply struct {
+  Err Err
+  Shard int       // the new half
+}
+
+type MergeShardsArgs struct {
+  Shard int       // either half
+}
+
+type MergeShardsReply struct {
+  Err Err
+  Shard int       // what the two halves are now
+}
+
+
+// Events
+
+type EventsArgs struct {
+  Since int     // only events with a higher Seq
+}
+
+type EventsReply struct {
+  Events []Event
+}
+
+
+// Drain
+
+type DrainArgs struct {
+  Server string
+}
+
+type DrainReply struct {
+  Err Err
+}
+
+
+type HeartbeatArgs struct {
+  ConfigDigest string
+}
+
+type HeartbeatReply struct {
 }
 
 
@@ -61,11 +227,14 @@ type StatusReply struct {
 
 type QuerySegmentsArgs struct {
   DeadPrimaries map[string][]int
+  Incarnations map[string]int64    // which incarnation of each dead primary died
+  ViewNumber uint     // the view the dead primaries were taken out of
 }
 
 type QuerySegmentsReply struct {
   ServerName string
   BackedUpSegments map[string]map[int64]map[int]bool
+  Digests map[string][]int64     // dead primary -> ids of its newest segment and all before it
 }
 
 
@@ -74,9 +243,35 @@ type QuerySegmentsReply struct {
 type ElectRecoveryMasterArgs struct {
   RecoveryData map[int]map[int64][]string
   DeadPrimaries map[string][]int
+  Partitions map[int]Partition     // keys each shard being recovered holds
 }
 
 type ElectRecoveryMasterReply struct {
   ServerName string
   ShardRecovered int
 }
+
+
+// MigrateShard
+
+type MigrateShardArgs struct {
+  Shard int
+  Destination string
+}
+
+type MigrateShardReply struct {
+  Err Err
+  OpsSent int
+  BeforeFreeze time.Duration   // from when the request came in until the shard was frozen
+}
+
+
+// HandoffBackups
+
+type HandoffBackupsArgs struct {
+}
+
+type HandoffBackupsReply struct {
+  Err Err
+  Unreplaced []string     // origins some of whose segments nobody else took
+}
@@ -0,0 +1,130 @@
+package viewservice
+
+import (
+  "crypto/md5"
+  "encoding/json"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "time"
+)
+
+
+// parameters of a cluster. the viewservice and every server must be started
+// with the same ones, apart from where a server keeps its files and how
+// patient it is; pings and heartbeats from a server or replica with a
+// different config are turned away.
+type Config struct {
+  PingInterval time.Duration    // how often servers ping the viewservice
+  DeadPings int                 // a server that misses this many pings is dead
+  CriticalMass int              // servers needed before there is a first view
+  NumberOfShards int
+  ReplicationLevel int          // backups of each log segment
+  RangePartitioned bool         // shards hold ranges of keys rather than of their hashes
+
+  SegLimit int                  // max number of bytes in a log segment
+  Retries int                   // times servers retry RPCs to each other
+  SegPath string                // absolute path where log segments are stored
+}
+
+
+// the settings the cluster had before they were configurable
+func DefaultConfig() Config {
+  config := Config{}
+  config.PingInterval = PING_INTERVAL
+  config.DeadPings = DEAD_PINGS
+  config.CriticalMass = CRITICAL_MASS
+  config.NumberOfShards = NUMBER_OF_SHARDS
+  config.ReplicationLevel = REPLICATION_LEVEL
+  config.SegLimit = 8 * 1024 * 1024
+  config.Retries = 5
+  config.SegPath = "/tmp/segment/"
+  return config
+}
+
+
+// reads a config from a JSON file. settings the file leaves out keep their
+// defaults; PingInterval is a duration such as "100ms".
+func LoadConfig(fname string) (Config, error) {
+  var file struct {
+    Config
+    PingInterval string
+  }
+  file.Config = DefaultConfig()
+
+  b, err := ioutil.ReadFile(fname)
+  if err != nil {
+    return Config{}, err
+  }
+  err = json.Unmarshal(b, &file)
+  if err != nil {
+    return Config{}, fmt.Errorf("%s: %v", fname, err)
+  }
+
+  config := file.Config
+  if file.PingInterval != "" {
+    config.PingInterval, err = time.ParseDuration(file.PingInterval)
+    if err != nil {
+      return Config{}, fmt.Errorf("%s: PingInterval: %v", fname, err)
+    }
+  }
+
+  return config, config.Check()
+}
+
+
+// complains about settings a cluster can't run with
+func (config Config) Check() error {
+  if config.PingInterval <= 0 || config.DeadPings < 2 {
+    return fmt.Errorf("need a positive PingInterval and at least 2 DeadPings")
+  }
+  if config.NumberOfShards < 1 || config.Retries < 1 || config.SegLimit < 1 {
+    return fmt.Errorf("need at least one shard, retry and byte per segment")
+  }
+  // the modulus of a shard split MAX_SPLITS times has to fit in a hash
+  if uint64(config.NumberOfShards) << MAX_SPLITS > uint64(^uint32(0)) {
+    return fmt.Errorf("NumberOfShards (%d) must be less than %d", config.NumberOfShards,
+      (uint64(^uint32(0)) >> MAX_SPLITS) + 1)
+  }
+  if config.ReplicationLevel < 1 || config.CriticalMass <= config.ReplicationLevel {
+    return fmt.Errorf("CriticalMass (%d) must be more than ReplicationLevel (%d), which must be positive",
+      config.CriticalMass, config.ReplicationLevel)
+  }
+  return nil
+}
+
+
+// identifies the settings every member of the cluster has to agree on
+func (config Config) Digest() string {
+  h := md5.New()
+  io.WriteString(h, fmt.Sprintf("%v %v %v %v %v %v %v", config.PingInterval, config.DeadPings,
+    config.CriticalMass, config.NumberOfShards, config.ReplicationLevel, config.SegLimit,
+    config.RangePartitioned))
+  return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+
+// how long a server may go without pinging before it is declared dead
+func (config Config) DeadTime() time.Duration {
+  return config.PingInterval * time.Duration(config.DeadPings)
+}
+
+
+// how long a primary may serve its shards after a ping without hearing from
+// the viewservice again. the viewservice doesn't recover a server's shards
+// until its lease has run out, so it must be shorter than DeadTime.
+func (config Config) LeaseTime() time.Duration {
+  return config.DeadTime() / 2
+}
+
+
+// placement policy defaults that suit the config
+func (config Config) PlacementPolicy() PlacementPolicy {
+  policy := PlacementPolicy{}
+  policy.MaxRecoveryMasters = config.CriticalMass
+  policy.ShardWeight  = 1.0
+  policy.MemoryWeight = 1.0 / 64     // 64MB of data is worth about a shard
+  policy.BackupWeight = 1.0 / 8      // as are 8 backed-up segments
+  policy.SuspectPings = config.DeadPings / 2
+  return policy
+}
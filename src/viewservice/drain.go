@@ -0,0 +1,149 @@
+package viewservice
+
+import (
+  "fmt"
+  "time"
+  "sort"
+)
+
+
+// operator request to take a server out of service without losing anything:
+// its shards are moved to other primaries, the segments it backs up are
+// handed to other backups, and only then is it dropped from serversAlive.
+// returns as soon as the drain has started; Status shows how it's going.
+func (vs *ViewServer) Drain(args *DrainArgs, reply *DrainReply) error {
+  vs.mu.Lock()
+  defer vs.mu.Unlock()
+
+  vs.catchUp(false)
+
+  if ! vs.leading {
+    reply.Err = ErrNotLeader
+    return nil
+  }
+
+  if ! vs.serversAlive[args.Server] {
+    reply.Err = ErrNotAlive
+    return nil
+  }
+
+  if vs.draining[args.Server] {
+    reply.Err = OK
+    return nil
+  }
+
+  // whoever is left needs to be able to take over its shards and backups
+  remaining := 0
+  for server, _ := range vs.serversAlive {
+    if server != args.Server && ! vs.draining[server] {
+      remaining++
+    }
+  }
+  if remaining < vs.config.ReplicationLevel + 1 {
+    reply.Err = ErrTooFewServers
+    return nil
+  }
+
+  fmt.Printf("Draining %s\n", args.Server)
+  _, err := vs.commit(JournalEntry{Type: DrainEntry, Server: args.Server})
+
+  reply.Err = err
+  return nil
+}
+
+
+// moves the next shard off a draining server, or has a draining server that
+// owns nothing hand off its backups. returns false if there was nothing to
+// do. callers must hold vs.mu.
+func (vs *ViewServer) drainStep() bool {
+
+  servers := make([]string, 0)
+  for server, _ := range vs.draining {
+    servers = append(servers, server)
+  }
+  sort.Strings(servers)
+
+  for _, server := range servers {
+
+    // if it died, the usual failure handling takes over
+    if ! vs.serversAlive[server] || vs.handingOff[server] {
+      continue
+    }
+
+    shard := -1
+    for s, primary := range vs.view.ShardsToPrimaries {
+      if primary == server && (shard == -1 || s < shard) {
+        shard = s
+      }
+    }
+
+    if shard == -1 {
+      vs.handingOff[server] = true
+      go vs.handoff(server)
+      return true
+    }
+
+    to, ok := vs.leastLoaded()
+    if ! ok {
+      return false
+    }
+
+    vs.migrations[shard] = to
+    go vs.migrate(shard, server, to)
+    return true
+  }
+
+  return false
+}
+
+
+// the live server that is primary for the fewest shards. callers must hold
+// vs.mu.
+func (vs *ViewServer) leastLoaded() (string, bool) {
+  least := vs.leastLoadedOf(vs.shardCounts())
+  return least, least != ""
+}
+
+
+// asks a draining server that is no longer primary for anything to pass the
+// segments it backs up on to other servers, then takes it out of service.
+func (vs *ViewServer) handoff(server string) {
+
+  fmt.Printf("Handing off backups of %s\n", server)
+
+  args  := &HandoffBackupsArgs{}
+  reply := &HandoffBackupsReply{}
+
+  ok := call(server, "PBServer.HandoffBackups", vs.networkMode, args, reply)
+
+  vs.mu.Lock()
+  defer vs.mu.Unlock()
+
+  delete(vs.handingOff, server)
+
+  if ! ok || reply.Err != OK {
+    fmt.Printf("Handing off backups of %s failed: %v\n", server, reply.Err)
+    vs.rebalanceAfter = time.Now().Add(vs.rebalanceBackoff())
+    return
+  }
+
+  if ! vs.draining[server] {
+    return
+  }
+
+  // what only it has may yet be needed to recover a server
+  for _, origin := range reply.Unreplaced {
+    if len(vs.recoveryInProcess[origin]) > 0 {
+      fmt.Printf("%s backs up %s, which is being recovered; not decommissioning it yet\n", server, origin)
+      vs.rebalanceAfter = time.Now().Add(vs.rebalanceBackoff())
+      return
+    }
+  }
+
+  _, err := vs.commit(JournalEntry{Type: DecommissionedEntry, Server: server})
+  if err != OK {
+    vs.rebalanceAfter = time.Now().Add(vs.rebalanceBackoff())
+    return
+  }
+  fmt.Printf("Decommissioned %s\n", server)
+}
@@ -0,0 +1,171 @@
+package viewservice
+
+import (
+  "bufio"
+  "encoding/json"
+  "fmt"
+  "os"
+  "path"
+  "strings"
+  "time"
+)
+
+
+// how many events the viewservice remembers
+const EVENT_LOG_SIZE = 1000
+
+// Event types
+const (
+  EventViewCreated = "ViewCreated"
+  EventServerDead = "ServerDead"
+  EventServerRestarted = "ServerRestarted"
+  EventRecoveryMasterElected = "RecoveryMasterElected"
+  EventShardRecovered = "ShardRecovered"
+  EventRecoveryCompleted = "RecoveryCompleted"
+  EventShardMoved = "ShardMoved"
+  EventServerDraining = "ServerDraining"
+  EventServerDecommissioned = "ServerDecommissioned"
+  EventShardSplit = "ShardSplit"
+  EventShardsMerged = "ShardsMerged"
+)
+
+
+// something that happened to the cluster, for post-mortems
+type Event struct {
+  Seq int
+  Time time.Time
+  Type string
+  Server string           // the server the event is about
+  Shards []int
+  RecoveryMaster string
+  From string             // ShardMoved: the old primary
+  ViewNumber uint
+  Duration time.Duration  // ShardRecovered, RecoveryCompleted: how long it took
+  Bytes int64             // ShardRecovered, RecoveryCompleted: data replayed
+}
+
+
+func (e Event) String() string {
+  s := fmt.Sprintf("%4d %s %-21s", e.Seq, e.Time.Format("15:04:05.000"), e.Type)
+  if e.Server != "" {
+    s += " " + e.Server
+  }
+  if e.From != "" {
+    s += " from " + e.From
+  }
+  if len(e.Shards) > 0 {
+    s += fmt.Sprintf(" shards %v", e.Shards)
+  }
+  if e.RecoveryMaster != "" {
+    s += " by " + e.RecoveryMaster
+  }
+  if e.ViewNumber > 0 {
+    s += fmt.Sprintf(" view %d", e.ViewNumber)
+  }
+  if e.Duration > 0 {
+    s += fmt.Sprintf(" in %v", e.Duration)
+  }
+  if e.Bytes > 0 {
+    s += fmt.Sprintf(" (%.2f MB)", float64(e.Bytes) / (1024 * 1024))
+  }
+  return s
+}
+
+
+// keeps the last EVENT_LOG_SIZE events, optionally appending each to a file
+// as well.
+type EventLog struct {
+  events []Event
+  next int       // Seq of the next event
+  file *os.File
+}
+
+
+func (l *EventLog) add(event Event) {
+  event.Seq = l.next
+  l.next++
+
+  l.events = append(l.events, event)
+  if len(l.events) > EVENT_LOG_SIZE {
+    l.events = l.events[1:]
+  }
+
+  if l.file != nil {
+    b, err := json.Marshal(event)
+    if err == nil {
+      l.file.Write(append(b, '\n'))
+    }
+  }
+}
+
+
+// events with Seq > since, oldest first
+func (l *EventLog) since(since int) []Event {
+  events := make([]Event, 0)
+  for _, event := range l.events {
+    if event.Seq > since {
+      events = append(events, event)
+    }
+  }
+  return events
+}
+
+
+// records event, unless we're only replaying the journal. callers must hold
+// vs.mu.
+func (vs *ViewServer) record(event Event) {
+  if vs.replaying {
+    return
+  }
+  vs.events.add(event)
+}
+
+
+// keeps events in fname as well, one JSON object per line, and picks up
+// where any events already there left off.
+func (vs *ViewServer) SetEventLog(fname string) {
+  vs.mu.Lock()
+  defer vs.mu.Unlock()
+
+  os.MkdirAll(path.Dir(fname), 0777)
+
+  // what an earlier run wrote comes first
+  events := new(EventLog)
+  fo, err := os.Open(fname)
+  if err == nil {
+    scanner := bufio.NewScanner(fo)
+    for scanner.Scan() {
+      var event Event
+      if json.Unmarshal([]byte(strings.TrimSpace(scanner.Text())), &event) == nil {
+        events.next = event.Seq
+        events.add(event)
+      }
+    }
+    fo.Close()
+  }
+
+  events.file, err = os.OpenFile(fname, os.O_CREATE | os.O_WRONLY | os.O_APPEND, 0666)
+  if err != nil {
+    fmt.Println(err)
+    os.Exit(1)
+  }
+
+  // then anything that happened before we were told about the file
+  for _, event := range vs.events.events {
+    events.add(event)
+  }
+
+  vs.events = events
+}
+
+
+// replies with the events after args.Since
+func (vs *ViewServer) Events(args *EventsArgs, reply *EventsReply) error {
+  vs.mu.Lock()
+  defer vs.mu.Unlock()
+
+  vs.catchUp(false)
+
+  reply.Events = vs.events.since(args.Since)
+  return nil
+}
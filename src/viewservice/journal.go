@@ -0,0 +1,203 @@
+package viewservice
+
+import (
+  "encoding/gob"
+  "os"
+  "io"
+  "fmt"
+  "path"
+  "crypto/md5"
+  "time"
+)
+
+
+// absolute path where the viewservice journal should be stored
+const JournalPath = "/tmp/viewservice/"
+
+// the journal is started over from a snapshot once it holds this many entries
+const SNAPSHOT_EVERY = 1000
+
+// Journal entry types
+const (
+  SnapshotEntry = iota
+  CriticalMassEntry
+  FailuresEntry
+  RecoveryMastersEntry
+  RecoveryCompletedEntry
+  NoOpEntry
+  ShardMovedEntry
+  IncarnationsEntry
+  DrainEntry
+  DecommissionedEntry
+  ShardSplitEntry
+  ShardsMergedEntry
+)
+
+
+// a single state transition of the viewservice. every change to the view or
+// to the recovery bookkeeping goes through one of these, so that replaying the
+// journal rebuilds exactly the state we had before a crash.
+type JournalEntry struct {
+  Type int
+  ID int64     // identifies the proposal when replicas agree on entries
+  Seq int      // position in the replicated log
+  Time time.Time   // when it was proposed
+
+  // SnapshotEntry
+  Snapshot Snapshot
+
+  // CriticalMassEntry
+  View View
+  PrimaryServers map[string]bool
+
+  // FailuresEntry: servers declared dead
+  Failures []string
+
+  // RecoveryMastersEntry: recovery master -> shards it was assigned
+  Assignments map[string][]int
+
+  // RecoveryCompletedEntry, ShardMovedEntry: Server is the new primary
+  // DrainEntry, DecommissionedEntry: Server is the one being taken out
+  // ShardSplitEntry, ShardsMergedEntry: Shard is the one split, or either half
+  Server string
+  Shard int
+  From string
+  Bytes int64     // RecoveryCompletedEntry: data the recovery master replayed
+  Key string      // ShardSplitEntry: first key of the new half of a range
+
+  // IncarnationsEntry: servers that started up, or restarted, as new incarnations
+  Incarnations map[string]int64
+}
+
+
+// everything the viewservice needs to survive a restart
+type Snapshot struct {
+  View View
+  CriticalMassReached bool
+  PrimaryServers map[string]bool
+  RecoveryInProcess map[string][]int
+  RecoveryMasters map[string]map[int]bool
+  Incarnations map[string]int64
+  DeadIncarnations map[string]int64
+  Draining map[string]bool
+  Decommissioned map[string]bool
+  AppliedSeq int
+}
+
+
+type Journal struct {
+  path string
+  file *os.File
+  enc *gob.Encoder
+  entries int     // written to file so far
+}
+
+
+// reads back every entry that made it to disk. a torn write at the tail of the
+// journal just ends the replay.
+func readJournal(fname string) []JournalEntry {
+  entries := make([]JournalEntry, 0)
+
+  fo, err := os.Open(fname)
+  if err != nil {
+    return entries
+  }
+  defer fo.Close()
+
+  dec := gob.NewDecoder(fo)
+  for {
+    var entry JournalEntry
+    err = dec.Decode(&entry)
+    if err != nil {
+      if err != io.EOF {
+        fmt.Println("journal truncated: ", err)
+      }
+      break
+    }
+    entries = append(entries, entry)
+  }
+
+  return entries
+}
+
+
+// starts a fresh journal for the given server, whose only entry is snapshot.
+// the old journal is replaced atomically once the snapshot is on disk.
+func startJournal(fname string, snapshot Snapshot) *Journal {
+  os.MkdirAll(path.Dir(fname), 0777)
+
+  tmp := fname + ".tmp"
+  fo, err := os.Create(tmp)
+  if err != nil {
+    fmt.Println(err)
+    os.Exit(1)
+  }
+
+  j := new(Journal)
+  j.path = fname
+  j.file = fo
+  j.enc = gob.NewEncoder(fo)
+
+  j.append(JournalEntry{Type: SnapshotEntry, Snapshot: snapshot})
+
+  err = os.Rename(tmp, fname)
+  if err == nil {
+    err = syncDir(path.Dir(fname))
+  }
+  if err != nil {
+    fmt.Println(err)
+    os.Exit(1)
+  }
+
+  return j
+}
+
+
+// makes a rename in dir durable
+func syncDir(dir string) error {
+  d, err := os.Open(dir)
+  if err != nil {
+    return err
+  }
+  defer d.Close()
+  return d.Sync()
+}
+
+
+// durably records entry. returns only once the entry is synced to disk.
+func (j *Journal) append(entry JournalEntry) {
+  if j.file == nil {
+    return
+  }
+  err := j.enc.Encode(entry)
+  if err == nil {
+    err = j.file.Sync()
+  }
+  if err != nil {
+    fmt.Println("journal: ", err)
+    os.Exit(1)
+  }
+  j.entries++
+}
+
+
+func (j *Journal) close() {
+  if j.file != nil {
+    j.file.Close()
+    j.file = nil
+  }
+}
+
+
+// where a replica keeps its paxos acceptor state
+func PaxosName(me string) string {
+  return JournalName(me) + ".paxos"
+}
+
+
+func JournalName(me string) string {
+  // hash host to make file name
+  h1 := md5.New()
+  io.WriteString(h1, me)
+  return path.Join(JournalPath, fmt.Sprintf("%x", h1.Sum([]byte{})))
+}
@@ -0,0 +1,415 @@
+package viewservice
+
+import (
+  "fmt"
+  "hash/adler32"
+  "math/big"
+)
+
+
+// keys start out spread over NumberOfShards shards by the hash of the key:
+// shard s holds the keys whose hash is s modulo NumberOfShards. splitting a
+// shard halves it. if shard s held the hashes that are s modulo m, it keeps
+// those that are s modulo 2m and a new shard s+m takes the rest; merging the
+// two undoes the split. a shard's number is always the one hash it holds
+// that is smaller than its modulus, and s % NumberOfShards is the shard its
+// keys started out in. backups keep track of ops by that, so that ops logged
+// before a split can still be found for either half.
+//
+// range-partitioned clusters instead give each shard a range of keys, the
+// first NumberOfShards of them about evenly spread over printable keys.
+// splitting one cuts its range in two, at a given key or about the middle,
+// and the new half gets the next unused shard number. merging a shard
+// joins it with the range right after it. backups still keep track of ops
+// by hash, so a recovery master needs every segment of the dead primary.
+
+// most times a shard can be split
+const MAX_SPLITS = 16
+
+
+func KeyHash(key string) uint32 {
+  return adler32.Checksum([]byte(key))
+}
+
+
+// the shard key was in before any shards were split
+func BaseShard(key string, nshards int) int {
+  if nshards <= 0 {
+    return 0
+  }
+  return int(KeyHash(key) % uint32(nshards))
+}
+
+
+// the keys a shard holds: those whose hash is Shard modulo Mod, or if Mod
+// is 0, those in Range
+type Partition struct {
+  Shard int
+  Mod uint32
+  Range KeyRange
+}
+
+func (p Partition) Holds(key string) bool {
+  if p.Mod == 0 {
+    return p.Range.Holds(key)
+  }
+  return KeyHash(key) % p.Mod == uint32(p.Shard)
+}
+
+
+func (r KeyRange) Holds(key string) bool {
+  return key >= r.Start && (r.End == "" || key < r.End)
+}
+
+
+func (v View) PartitionOf(shard int) Partition {
+  if v.Ranges != nil {
+    return Partition{Shard: shard, Range: v.Ranges[shard]}
+  }
+  return Partition{Shard: shard, Mod: uint32(v.NumberOfShards) << v.Splits[shard]}
+}
+
+
+// the shard that holds key in this view
+func (v View) ShardForKey(key string) int {
+  if v.NumberOfShards <= 0 {
+    return 0
+  }
+
+  if v.Ranges != nil {
+    for shard, r := range v.Ranges {
+      if r.Holds(key) {
+        return shard
+      }
+    }
+    return 0
+  }
+
+  // the shard holding key is the only one whose modulus leaves it the
+  // shard's number
+  hash := KeyHash(key)
+  for splits := uint(0); splits <= MAX_SPLITS; splits++ {
+    shard := int(hash % (uint32(v.NumberOfShards) << splits))
+    if v.Splits[shard] == splits {
+      return shard
+    }
+  }
+  return BaseShard(key, v.NumberOfShards)
+}
+
+
+// a copy of the view that shares no maps with it, for handing out while
+// the original keeps changing
+func (v View) clone() View {
+  c := v
+  if v.ShardsToPrimaries != nil {
+    c.ShardsToPrimaries = make(map[int]string)
+    for shard, primary := range v.ShardsToPrimaries {
+      c.ShardsToPrimaries[shard] = primary
+    }
+  }
+  if v.Splits != nil {
+    c.Splits = make(map[int]uint)
+    for shard, splits := range v.Splits {
+      c.Splits[shard] = splits
+    }
+  }
+  if v.Ranges != nil {
+    c.Ranges = make(map[int]KeyRange)
+    for shard, r := range v.Ranges {
+      c.Ranges[shard] = r
+    }
+  }
+  return c
+}
+
+
+// every shard in the view, whether or not it has a primary at the moment
+func (v View) Shards() []int {
+  shards := make([]int, 0)
+  if v.Ranges != nil {
+    for shard, _ := range v.Ranges {
+      shards = append(shards, shard)
+    }
+    return shards
+  }
+
+  // a shard split more often than it has been so far was halved into
+  // itself and the shard one modulus up
+  var halves func(shard int, splits uint)
+  halves = func(shard int, splits uint) {
+    if v.Splits[shard] <= splits {
+      shards = append(shards, shard)
+      return
+    }
+    halves(shard, splits + 1)
+    halves(shard + (v.NumberOfShards << splits), splits + 1)
+  }
+  for shard := 0; shard < v.NumberOfShards; shard++ {
+    halves(shard, 0)
+  }
+  return shards
+}
+
+
+// the two shards that merging shard would join, lower one first, and
+// whether there are two
+func (v View) siblings(shard int) (int, int, bool) {
+  if v.Ranges != nil {
+    r, ok := v.Ranges[shard]
+    if ! ok || r.End == "" {
+      return 0, 0, false
+    }
+    for next, nr := range v.Ranges {
+      if nr.Start == r.End {
+        return shard, next, true
+      }
+    }
+    return 0, 0, false
+  }
+
+  splits := v.Splits[shard]
+  if splits == 0 {
+    return 0, 0, false
+  }
+  half := v.NumberOfShards << (splits - 1)
+  low  := shard % half
+  high := low + half
+  return low, high, v.Splits[low] == splits && v.Splits[high] == splits
+}
+
+
+// number the new half of a split gets
+func (v View) childOf(shard int) int {
+  if v.Ranges != nil {
+    child := 0
+    for s, _ := range v.Ranges {
+      if s >= child {
+        child = s + 1
+      }
+    }
+    return child
+  }
+  return shard + int(v.PartitionOf(shard).Mod)
+}
+
+
+// the first NumberOfShards ranges: the space of two-character printable keys
+// cut into n about equal pieces
+func initialRanges(n int) map[int]KeyRange {
+  const first, chars = ' ', '~' - ' ' + 1
+
+  boundary := func(i int) string {
+    if i == 0 || i == n {
+      return ""
+    }
+    at := i * chars * chars / n
+    return string([]byte{byte(first + at / chars), byte(first + at % chars)})
+  }
+
+  ranges := make(map[int]KeyRange)
+  for shard := 0; shard < n; shard++ {
+    ranges[shard] = KeyRange{Start: boundary(shard), End: boundary(shard + 1)}
+  }
+  return ranges
+}
+
+
+// a key about halfway between start and end, or "" if there is none
+func midKey(start string, end string) string {
+  n := len(start)
+  if len(end) > n {
+    n = len(end)
+  }
+  n++
+
+  // as fractions of 256^n, padded out with zeros
+  pad := func(s string) *big.Int {
+    b := make([]byte, n)
+    copy(b, s)
+    return new(big.Int).SetBytes(b)
+  }
+
+  var hi *big.Int
+  if end == "" {
+    hi = new(big.Int).Lsh(big.NewInt(1), uint(8 * n))
+  } else {
+    hi = pad(end)
+  }
+  mid := new(big.Int).Add(pad(start), hi)
+  mid.Rsh(mid, 1)
+
+  b := mid.Bytes()
+  b = append(make([]byte, n - len(b)), b...)
+  for len(b) > 0 && b[len(b)-1] == 0 {
+    b = b[:len(b)-1]
+  }
+
+  key := string(b)
+  if key <= start || (end != "" && key >= end) {
+    return ""
+  }
+  return key
+}
+
+
+// operator request to split a shard in two. the new half stays with the
+// same primary until it is moved, by MoveShard or by the rebalancer.
+func (vs *ViewServer) SplitShard(args *SplitShardArgs, reply *SplitShardReply) error {
+  vs.mu.Lock()
+  defer vs.mu.Unlock()
+
+  vs.catchUp(false)
+
+  if ! vs.leading {
+    reply.Err = ErrNotLeader
+    return nil
+  }
+
+  _, ok := vs.view.ShardsToPrimaries[args.Shard]
+  if ! ok {
+    reply.Err = ErrUnknownShard
+    return nil
+  }
+
+  _, busy := vs.migrations[args.Shard]
+  if busy {
+    reply.Err = ErrBusy
+    return nil
+  }
+
+  key := ""
+  if vs.view.Ranges != nil {
+    r := vs.view.Ranges[args.Shard]
+    key = args.Key
+    if key == "" {
+      key = midKey(r.Start, r.End)
+    }
+    if key <= r.Start || ! r.Holds(key) {
+      reply.Err = ErrBadKey
+      return nil
+    }
+  } else if vs.view.Splits[args.Shard] >= MAX_SPLITS {
+    reply.Err = ErrTooManySplits
+    return nil
+  }
+
+  child := vs.view.childOf(args.Shard)
+
+  fmt.Printf("Splitting shard %d into %d and %d\n", args.Shard, args.Shard, child)
+  _, err := vs.commit(JournalEntry{Type: ShardSplitEntry, Shard: args.Shard, Key: key})
+
+  reply.Shard = child
+  reply.Err = err
+  return nil
+}
+
+
+// operator request to merge a shard with the other half of the shard it was
+// split from, or for ranges, with the range right after it. both have to be
+// with the same primary.
+func (vs *ViewServer) MergeShards(args *MergeShardsArgs, reply *MergeShardsReply) error {
+  vs.mu.Lock()
+  defer vs.mu.Unlock()
+
+  vs.catchUp(false)
+
+  if ! vs.leading {
+    reply.Err = ErrNotLeader
+    return nil
+  }
+
+  _, ok := vs.view.ShardsToPrimaries[args.Shard]
+  if ! ok {
+    reply.Err = ErrUnknownShard
+    return nil
+  }
+
+  low, high, ok := vs.view.siblings(args.Shard)
+  if ! ok {
+    reply.Err = ErrNotSplit
+    return nil
+  }
+
+  lowPrimary, ok1  := vs.view.ShardsToPrimaries[low]
+  highPrimary, ok2 := vs.view.ShardsToPrimaries[high]
+  if ! ok1 || ! ok2 {
+    reply.Err = ErrUnknownShard
+    return nil
+  }
+  if lowPrimary != highPrimary {
+    reply.Err = ErrNotColocated
+    return nil
+  }
+
+  _, busy1 := vs.migrations[low]
+  _, busy2 := vs.migrations[high]
+  if busy1 || busy2 {
+    reply.Err = ErrBusy
+    return nil
+  }
+
+  fmt.Printf("Merging shards %d and %d\n", low, high)
+  _, err := vs.commit(JournalEntry{Type: ShardsMergedEntry, Shard: args.Shard})
+
+  reply.Shard = low
+  reply.Err = err
+  return nil
+}
+
+
+// applies a ShardSplitEntry. callers must hold vs.mu.
+func (vs *ViewServer) splitShard(shard int, key string) []int {
+  primary, ok := vs.view.ShardsToPrimaries[shard]
+  if ! ok {
+    return nil
+  }
+
+  child := vs.view.childOf(shard)
+
+  if vs.view.Ranges != nil {
+    r := vs.view.Ranges[shard]
+    vs.view.Ranges[shard] = KeyRange{Start: r.Start, End: key}
+    vs.view.Ranges[child] = KeyRange{Start: key, End: r.End}
+    vs.view.ShardsToPrimaries[child] = primary
+    return []int{shard, child}
+  }
+
+  if vs.view.Splits == nil {
+    vs.view.Splits = make(map[int]uint)
+  }
+  vs.view.Splits[shard]++
+  vs.view.Splits[child] = vs.view.Splits[shard]
+  vs.view.ShardsToPrimaries[child] = primary
+  return []int{shard, child}
+}
+
+
+// applies a ShardsMergedEntry. callers must hold vs.mu.
+func (vs *ViewServer) mergeShards(shard int) []int {
+  low, high, ok := vs.view.siblings(shard)
+  if ! ok {
+    return nil
+  }
+
+  primary, ok1 := vs.view.ShardsToPrimaries[low]
+  other, ok2   := vs.view.ShardsToPrimaries[high]
+  if ! ok1 || ! ok2 || primary != other {
+    return nil
+  }
+
+  delete(vs.view.ShardsToPrimaries, high)
+
+  if vs.view.Ranges != nil {
+    vs.view.Ranges[low] = KeyRange{Start: vs.view.Ranges[low].Start, End: vs.view.Ranges[high].End}
+    delete(vs.view.Ranges, high)
+    return []int{low, high}
+  }
+
+  delete(vs.view.Splits, high)
+  vs.view.Splits[low]--
+  if vs.view.Splits[low] == 0 {
+    delete(vs.view.Splits, low)
+  }
+  return []int{low, high}
+}
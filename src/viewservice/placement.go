@@ -0,0 +1,253 @@
+package viewservice
+
+import (
+  "time"
+  "sort"
+)
+
+
+// how the viewservice decides which servers should take on more work
+type PlacementPolicy struct {
+  MaxRecoveryMasters int      // at most this many recovery masters at once; 0 means no limit
+  ShardWeight float64         // cost of each shard a server is primary for (or recovering)
+  MemoryWeight float64        // cost of each MB in a server's store
+  BackupWeight float64        // cost of each segment a server backs up
+  SuspectPings int            // servers that have missed this many pings are passed over
+}
+
+func DefaultPlacementPolicy() PlacementPolicy {
+  return DefaultConfig().PlacementPolicy()
+}
+
+
+func (vs *ViewServer) SetPlacementPolicy(policy PlacementPolicy) {
+  vs.mu.Lock()
+  defer vs.mu.Unlock()
+  vs.policy = policy
+}
+
+
+// how loaded a server is according to the policy, for its size. callers
+// must hold vs.mu.
+func (vs *ViewServer) loadScore(server string, shardCounts map[string]int) float64 {
+  load := vs.serverLoads[server]
+
+  shards := shardCounts[server] + len(vs.recoveryMasters[server])
+
+  score := vs.policy.ShardWeight * float64(shards)
+  score += vs.policy.MemoryWeight * float64(load.StoreBytes) / float64(1024 * 1024)
+  score += vs.policy.BackupWeight * float64(load.BackedUpSegments)
+  return score / vs.capacityWeight(server)
+}
+
+
+// how big server is compared to the others: its capacity over the average
+// of those that reported one. a server that didn't report one is taken to
+// be average. callers must hold vs.mu.
+func (vs *ViewServer) capacityWeight(server string) float64 {
+  capacity := vs.serverLoads[server].Capacity
+  if capacity <= 0 {
+    return 1.0
+  }
+
+  var total int64 = 0
+  reported := 0
+  for s, _ := range vs.serversAlive {
+    if vs.serverLoads[s].Capacity > 0 {
+      total += vs.serverLoads[s].Capacity
+      reported++
+    }
+  }
+  if reported == 0 {
+    return 1.0
+  }
+  return float64(capacity) * float64(reported) / float64(total)
+}
+
+
+// shards per unit of capacity, were server to have count of them.
+// callers must hold vs.mu.
+func (vs *ViewServer) shardDensity(server string, count int) float64 {
+  return float64(count) / vs.capacityWeight(server)
+}
+
+
+// assigns every shard to one of servers, in proportion to their capacity and
+// taking turns between failure domains. callers must hold vs.mu.
+func (vs *ViewServer) initialPlacement(servers []string) map[int]string {
+  servers = vs.interleaveDomains(servers)
+
+  placement := make(map[int]string)
+  counts := make(map[string]int)
+  for shard := 0; shard < vs.config.NumberOfShards; shard++ {
+    // whoever would be least full with one more; the first in turn on a tie
+    best := servers[0]
+    for _, server := range servers {
+      if vs.shardDensity(server, counts[server] + 1) < vs.shardDensity(best, counts[best] + 1) {
+        best = server
+      }
+    }
+    placement[shard] = best
+    counts[best]++
+
+    // the winner goes to the back of the line
+    next := make([]string, 0, len(servers))
+    for _, server := range servers {
+      if server != best {
+        next = append(next, server)
+      }
+    }
+    servers = append(next, best)
+  }
+  return placement
+}
+
+
+// the failure domain server declared, or the server itself if it didn't.
+// callers must hold vs.mu.
+func (vs *ViewServer) domainOf(server string) string {
+  domain, ok := vs.domains[server]
+  if ! ok {
+    return server
+  }
+  return domain
+}
+
+
+// orders servers so that each failure domain takes its turn: the first
+// server of every domain, then the second of every domain, and so on.
+// callers must hold vs.mu.
+func (vs *ViewServer) interleaveDomains(servers []string) []string {
+  byDomain := make(map[string][]string)
+  domains  := make([]string, 0)
+  for _, server := range servers {
+    domain := vs.domainOf(server)
+    if len(byDomain[domain]) == 0 {
+      domains = append(domains, domain)
+    }
+    byDomain[domain] = append(byDomain[domain], server)
+  }
+  sort.Strings(domains)
+
+  interleaved := make([]string, 0, len(servers))
+  for round := 0; len(interleaved) < len(servers); round++ {
+    for _, domain := range domains {
+      if round < len(byDomain[domain]) {
+        interleaved = append(interleaved, byDomain[domain][round])
+      }
+    }
+  }
+  return interleaved
+}
+
+
+// the server in counts that would have the fewest shards for its capacity
+// with one more; ties go to the one whose failure domain has the fewest
+// shards. callers must hold vs.mu.
+func (vs *ViewServer) leastLoadedOf(counts map[string]int) string {
+  domainCounts := make(map[string]int)
+  servers := make([]string, 0)
+  for server, count := range counts {
+    domainCounts[vs.domainOf(server)] += count
+    servers = append(servers, server)
+  }
+  sort.Strings(servers)
+
+  least := ""
+  for _, server := range servers {
+    if least == "" {
+      least = server
+      continue
+    }
+    density      := vs.shardDensity(server, counts[server] + 1)
+    leastDensity := vs.shardDensity(least, counts[least] + 1)
+    if density < leastDensity ||
+       (density == leastDensity && domainCounts[vs.domainOf(server)] < domainCounts[vs.domainOf(least)]) {
+      least = server
+    }
+  }
+  return least
+}
+
+
+// has server been quiet long enough that it may be on its way out?
+// callers must hold vs.mu.
+func (vs *ViewServer) isSuspect(server string) bool {
+  lastPing, ok := vs.serverPings[server]
+  if ! ok {
+    return true
+  }
+  return time.Since(lastPing) >= vs.config.PingInterval * time.Duration(vs.policy.SuspectPings)
+}
+
+
+// assigns shards to recovery masters chosen from candidates: the least
+// loaded ones that look healthy, without going over the policy's limit on
+// recovery masters. callers must hold vs.mu.
+func (vs *ViewServer) pickRecoveryMasters(candidates []string, shards []int) map[string][]int {
+
+  assignments := make(map[string][]int)
+  if len(candidates) == 0 || len(shards) == 0 {
+    return assignments
+  }
+
+  healthy := make([]string, 0)
+  for _, server := range candidates {
+    if ! vs.isSuspect(server) {
+      healthy = append(healthy, server)
+    }
+  }
+  if len(healthy) == 0 {
+    healthy = candidates
+  }
+
+  shardCounts := vs.shardCounts()
+  scores := make(map[string]float64)
+  for _, server := range healthy {
+    scores[server] = vs.loadScore(server, shardCounts)
+  }
+
+  sort.Strings(healthy)
+  sort.SliceStable(healthy, func(i, j int) bool {
+    return scores[healthy[i]] < scores[healthy[j]]
+  })
+
+  // recovery masters already at work count against the limit, but can
+  // take on more.
+  pool := make([]string, 0)
+  active := 0
+  for _, server := range healthy {
+    _, busy := vs.recoveryMasters[server]
+    if busy {
+      active++
+    }
+  }
+  for _, server := range healthy {
+    _, busy := vs.recoveryMasters[server]
+    if busy || vs.policy.MaxRecoveryMasters <= 0 || active < vs.policy.MaxRecoveryMasters {
+      pool = append(pool, server)
+      if ! busy {
+        active++
+      }
+    }
+  }
+  if len(pool) == 0 {
+    // somebody has to do it
+    pool = healthy[:1]
+  }
+
+  // each shard goes to whoever is least loaded, counting what they've
+  // been given so far.
+  for _, shard := range shards {
+    best := pool[0]
+    for _, server := range pool {
+      if scores[server] < scores[best] {
+        best = server
+      }
+    }
+    assignments[best] = append(assignments[best], shard)
+    scores[best] += vs.policy.ShardWeight / vs.capacityWeight(best)
+  }
+
+  return assignments
+}
@@ -0,0 +1,160 @@
+package viewservice
+
+import (
+  "time"
+  "sort"
+)
+
+
+// a recovery master has been assigned shard; its recovery starts over.
+// callers must hold vs.mu.
+func (vs *ViewServer) startShardRecovery(shard int, recoveryMaster string, at time.Time) {
+  server := vs.deadOwner(shard)
+  if server == "" {
+    return
+  }
+
+  shards, ok := vs.recoveries[server]
+  if ! ok {
+    // e.g. restored from a journal
+    shards = make(map[int]*ShardRecovery)
+    vs.recoveries[server] = shards
+  }
+
+  progress := new(ShardRecovery)
+  progress.RecoveryMaster = recoveryMaster
+  progress.Started = at
+  shards[shard] = progress
+}
+
+
+// entry says that recovery of one of dead's shards is done.
+// callers must hold vs.mu.
+func (vs *ViewServer) finishShardRecovery(dead string, entry JournalEntry, at time.Time) {
+  if dead == "" {
+    return
+  }
+
+  progress, ok := vs.recoveries[dead][entry.Shard]
+  if ! ok {
+    progress = &ShardRecovery{RecoveryMaster: entry.Server, Started: at}
+    if vs.recoveries[dead] == nil {
+      vs.recoveries[dead] = make(map[int]*ShardRecovery)
+    }
+    vs.recoveries[dead][entry.Shard] = progress
+  }
+
+  progress.Done = true
+  progress.Elapsed = at.Sub(progress.Started)
+  progress.SegmentsFetched = progress.SegmentsNeeded
+  if entry.Bytes > progress.BytesReplayed {
+    progress.BytesReplayed = entry.Bytes
+  }
+
+  vs.record(Event{Time: at, Type: EventShardRecovered, Server: dead, Shards: []int{entry.Shard},
+    RecoveryMaster: entry.Server, Duration: progress.Elapsed, Bytes: progress.BytesReplayed})
+}
+
+
+// every shard of dead has been recovered. callers must hold vs.mu.
+func (vs *ViewServer) recoveryDone(dead string, at time.Time) {
+  var bytes int64 = 0
+  shards := make([]int, 0)
+  for shard, progress := range vs.recoveries[dead] {
+    bytes += progress.BytesReplayed
+    shards = append(shards, shard)
+  }
+  sort.Ints(shards)
+
+  event := Event{Time: at, Type: EventRecoveryCompleted, Server: dead, Shards: shards, Bytes: bytes}
+  failedAt, ok := vs.failedAt[dead]
+  if ok {
+    event.Duration = at.Sub(failedAt)
+  }
+  vs.record(event)
+
+  // keep reporting only the latest few
+  vs.recovered = append(vs.recovered, dead)
+  for len(vs.recovered) > RECOVERIES_KEPT {
+    delete(vs.recoveries, vs.recovered[0])
+    delete(vs.failedAt, vs.recovered[0])
+    vs.recovered = vs.recovered[1:]
+  }
+}
+
+
+// drops what we have on the recovery of server. callers must hold vs.mu.
+func (vs *ViewServer) forgetRecovery(server string) {
+  delete(vs.recoveries, server)
+  delete(vs.failedAt, server)
+  for i, s := range vs.recovered {
+    if s == server {
+      vs.recovered = append(vs.recovered[:i], vs.recovered[i+1:]...)
+      break
+    }
+  }
+}
+
+
+// recovery masters report how far along they are. every replica keeps
+// track, so that any of them can answer Status.
+func (vs *ViewServer) RecoveryProgress(args *RecoveryProgressArgs, reply *RecoveryProgressReply) error {
+  vs.mu.Lock()
+  defer vs.mu.Unlock()
+
+  vs.catchUp(false)
+
+  // the leader is the one watching recovery masters for stalls
+  if ! vs.leading {
+    reply.Err = ErrNotLeader
+    return nil
+  }
+  reply.Err = OK
+
+  server := vs.deadOwner(args.Shard)
+  progress, ok := vs.recoveries[server][args.Shard]
+  if ! ok || progress.Done || progress.RecoveryMaster != args.ServerName {
+    return nil
+  }
+
+  progress.SegmentsNeeded  = args.SegmentsNeeded
+  progress.SegmentsFetched = args.SegmentsFetched
+  progress.BytesReplayed   = args.BytesReplayed
+
+  // fetching segments counts as getting something done
+  _, watched := vs.recoveryProgress[args.ServerName]
+  if watched {
+    vs.recoveryProgress[args.ServerName] = time.Now()
+  }
+
+  return nil
+}
+
+
+// a copy of the recovery telemetry, with elapsed times and estimates filled
+// in. callers must hold vs.mu.
+func (vs *ViewServer) recoveryStatus() map[string]map[int]ShardRecovery {
+  status := make(map[string]map[int]ShardRecovery)
+
+  for server, shards := range vs.recoveries {
+    status[server] = make(map[int]ShardRecovery)
+
+    for shard, progress := range shards {
+      p := *progress
+
+      if ! p.Done {
+        p.Elapsed = time.Since(p.Started)
+
+        // assume the rest goes as fast as what we've seen so far
+        if p.SegmentsFetched > 0 && p.SegmentsNeeded > p.SegmentsFetched {
+          left := p.SegmentsNeeded - p.SegmentsFetched
+          p.ETA = p.Elapsed * time.Duration(left) / time.Duration(p.SegmentsFetched)
+        }
+      }
+
+      status[server][shard] = p
+    }
+  }
+
+  return status
+}
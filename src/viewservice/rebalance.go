@@ -0,0 +1,180 @@
+package viewservice
+
+import (
+  "fmt"
+  "time"
+  "sort"
+)
+
+
+// the old primary keeps a handed-off shard frozen for twice this long; the
+// view has to move the shard well before then.
+const HANDOFF_TIMEOUT = 5 * time.Second
+
+// how long the rebalancer leaves a shard an operator moved where it is
+const PIN_TIME = 10 * time.Minute
+
+
+// number of shards each live server is primary for. draining servers are
+// left out. callers must hold vs.mu.
+func (vs *ViewServer) shardCounts() map[string]int {
+  counts := make(map[string]int)
+
+  for server, _ := range vs.serversAlive {
+    if ! vs.draining[server] {
+      counts[server] = 0
+    }
+  }
+
+  for _, primary := range vs.view.ShardsToPrimaries {
+    _, alive := counts[primary]
+    if alive {
+      counts[primary]++
+    }
+  }
+
+  return counts
+}
+
+
+// how long the rebalancer waits after a failed handoff before trying again
+func (vs *ViewServer) rebalanceBackoff() time.Duration {
+  return vs.config.DeadTime()
+}
+
+
+// picks a shard to move from the most loaded live server to the least loaded
+// one, for their capacities, if that leaves the least loaded one still less
+// loaded than the other was. callers must hold vs.mu.
+func (vs *ViewServer) pickMove() (int, string, string, bool) {
+  counts := vs.shardCounts()
+
+  servers := make([]string, 0)
+  for server, _ := range counts {
+    servers = append(servers, server)
+  }
+  sort.Strings(servers)
+
+  most  := ""
+  for _, server := range servers {
+    if most == "" || vs.shardDensity(server, counts[server]) > vs.shardDensity(most, counts[most]) {
+      most = server
+    }
+  }
+  least := vs.leastLoadedOf(counts)
+
+  if most == "" || vs.shardDensity(least, counts[least] + 1) >= vs.shardDensity(most, counts[most]) {
+    return 0, "", "", false
+  }
+
+  // lowest numbered shard of the most loaded server that an operator
+  // hasn't put there lately
+  shard := -1
+  for s, primary := range vs.view.ShardsToPrimaries {
+    if primary == most && (shard == -1 || s < shard) && ! time.Now().Before(vs.pinned[s]) {
+      shard = s
+    }
+  }
+  if shard == -1 {
+    return 0, "", "", false
+  }
+
+  return shard, most, least, true
+}
+
+
+// operator request to move a shard to a new primary. returns once the
+// handoff is done, or has failed.
+func (vs *ViewServer) MoveShard(args *MoveShardArgs, reply *MoveShardReply) error {
+  vs.mu.Lock()
+
+  vs.catchUp(false)
+
+  if ! vs.leading {
+    vs.mu.Unlock()
+    reply.Err = ErrNotLeader
+    return nil
+  }
+
+  from, ok := vs.view.ShardsToPrimaries[args.Shard]
+  if ! ok {
+    vs.mu.Unlock()
+    reply.Err = ErrUnknownShard
+    return nil
+  }
+
+  if ! vs.serversAlive[args.Destination] || vs.draining[args.Destination] {
+    vs.mu.Unlock()
+    reply.Err = ErrNotAlive
+    return nil
+  }
+
+  _, busy := vs.migrations[args.Shard]
+  if busy {
+    vs.mu.Unlock()
+    reply.Err = ErrBusy
+    return nil
+  }
+
+  if from == args.Destination {
+    vs.mu.Unlock()
+    reply.Err = OK
+    return nil
+  }
+
+  vs.migrations[args.Shard] = args.Destination
+  vs.mu.Unlock()
+
+  reply.Err = vs.migrate(args.Shard, from, args.Destination)
+  if reply.Err == OK {
+    vs.mu.Lock()
+    vs.pinned[args.Shard] = time.Now().Add(PIN_TIME)
+    vs.mu.Unlock()
+  }
+  return nil
+}
+
+
+// hands shard off from one primary to another, and moves it in the view
+// once the new primary has everything.
+func (vs *ViewServer) migrate(shard int, from string, to string) Err {
+
+  fmt.Printf("Moving shard %d from %s to %s\n", shard, from, to)
+
+  args  := &MigrateShardArgs{Shard: shard, Destination: to}
+  reply := &MigrateShardReply{}
+
+  // the shard was frozen no earlier than this, by the old primary's clock
+  // running as fast as ours
+  sent := time.Now()
+  ok := call(from, "PBServer.MigrateShard", vs.networkMode, args, reply)
+
+  vs.mu.Lock()
+  defer vs.mu.Unlock()
+
+  delete(vs.migrations, shard)
+
+  if ! ok || reply.Err != OK {
+    fmt.Printf("Moving shard %d failed: %v\n", shard, reply.Err)
+    vs.rebalanceAfter = time.Now().Add(vs.rebalanceBackoff())
+    return ErrMoveFailed
+  }
+
+  // the old primary won't hold on to the shard forever. it has been frozen
+  // for at most the time since we sent the request, less what it took
+  // to freeze it
+  if time.Since(sent) - reply.BeforeFreeze >= HANDOFF_TIMEOUT {
+    fmt.Printf("Moving shard %d took too long; leaving it where it was.\n", shard)
+    vs.rebalanceAfter = time.Now().Add(vs.rebalanceBackoff())
+    return ErrMoveFailed
+  }
+
+  _, err := vs.commit(JournalEntry{Type: ShardMovedEntry, Shard: shard, From: from, Server: to})
+  if err != OK {
+    vs.rebalanceAfter = time.Now().Add(vs.rebalanceBackoff())
+    return err
+  }
+
+  fmt.Printf("Moved shard %d to %s (%d ops)\n", shard, to, reply.OpsSent)
+  return OK
+}
@@ -10,6 +10,9 @@ import (
   "os"
   "strings"
   "sort"
+  "math/rand"
+  "encoding/gob"
+  "paxos"
 )
 
 
@@ -20,6 +23,10 @@ type ViewServer struct {
   dead bool
   me string
 
+  config Config
+  configDigest string
+  badConfigs map[string] bool     // servers told their config doesn't match ours
+
   // view state
   view View
   criticalMassReached bool        // minimum number of servers/primaries reached
@@ -27,30 +34,138 @@ type ViewServer struct {
   // server states
   serverPings map[string] time.Time    // all servers including primaries, backups, and unused
   serversAlive map[string] bool      // all servers which can currently communicate with the viewservice
+  serverLoads map[string] ServerLoad   // as last reported by each server
+  domains map[string] string           // failure domains servers declared in their pings
   primaryServers map[string] bool      // tracks which servers are primaries
   recoveryInProcess map[string][]int
 
+  // a server that restarts under the same name comes back as a new
+  // incarnation with none of its old state.
+  incarnations map[string] int64       // as recorded in the journal
+  pinged map[string] int64             // as last reported in a ping
+  deadIncarnations map[string] int64   // incarnation of each server in recoveryInProcess
+
+  // leases we granted while leading; a server's shards aren't recovered
+  // before its lease is up
+  leases map[string] time.Time
+
   //keep track of which shards need to be recovered
   recoveryMasters map[string]map[int]bool
   recoveryTimes map[string] time.Time
 
+  // watching over recovery masters
+  recoveryProgress map[string] time.Time        // last time each recovery master got something done
+  failedRecoveryMasters map[string] bool        // ElectRecoveryMaster calls that didn't go through
+  excludedRecoveryMasters map[string] time.Time // recently failed; don't pick them again for a while
+  assigning map[int] bool                       // shards waiting for a recovery master to be picked
+
+  // progress of each shard's recovery, by dead server
+  recoveries map[string]map[int]*ShardRecovery
+  failedAt map[string] time.Time      // when each of those servers was declared dead
+  recovered []string                  // servers whose recovery is done, oldest first
+
+  // history of what happened, for post-mortems
+  events *EventLog
+  replaying bool     // restoring from the journal; those events are old news
+
+  // dead servers whose logs are missing segments
+  lostSegments map[string][]int64
+  refusedAt map[string] time.Time     // when we last declined to recover them
+  allowDataLoss bool                  // recover them anyway from what's left
+
+  policy PlacementPolicy
+
+  // shards being handed off to a new primary -> destination
+  migrations map[int]string
+  rebalanceAfter time.Time
+
+  // shards an operator moved, and until when the rebalancer leaves them
+  // where they are. kept by the leader only; a new leader forgets them.
+  pinned map[int]time.Time
+
+  // servers being taken out of service, and those that have been
+  draining map[string] bool
+  handingOff map[string] bool      // draining servers passing on their backups
+  decommissioned map[string] bool
+
+  // durable record of every state transition
+  journal *Journal
+  startTime time.Time
+  resuming bool      // restored from the journal; in-flight recoveries may need restarting
+
+  // signalled whenever the view changes, for WatchView. uses vs.mu.
+  viewChanged *sync.Cond
+
+  // replication: replicas agree on journal entries through paxos.
+  // px is nil when the viewservice runs as a single process.
+  px *paxos.Paxos
+  replicas []string
+  replica int                     // my index into replicas
+  applied int                     // next log sequence number to apply
+  stalled int                     // undecided seq seen on the previous tick
+  pending map[int64]*pendingEntry // entries commit() is waiting on, by ID
+  lastHeard map[int] time.Time    // last heartbeat from each lower-numbered replica
+  leading bool
+
   networkMode string
 
 }
 
+// a journal entry commit() is waiting to see in the log
+type pendingEntry struct {
+  applied bool
+  newFailures map[string][]int    // what applying it returned
+}
+
 
 // replies with current view
 func (vs *ViewServer) Get(args *GetArgs, reply *GetReply) error {
   vs.mu.Lock()
   defer vs.mu.Unlock()
 
+  vs.catchUp(false)
+
   // reply with the current view
-  reply.View = vs.view
+  reply.View = vs.view.clone()
 
   return nil
 
 }
 
+
+// replies as soon as there is a view newer than args.ViewNumber, or with the
+// current view once args.Timeout (or WATCH_TIMEOUT) runs out.
+func (vs *ViewServer) WatchView(args *WatchViewArgs, reply *WatchViewReply) error {
+  vs.mu.Lock()
+  defer vs.mu.Unlock()
+
+  vs.catchUp(false)
+
+  timeout := args.Timeout
+  if timeout <= 0 || timeout > WATCH_TIMEOUT {
+    timeout = WATCH_TIMEOUT
+  }
+
+  expired := false
+  timer := time.AfterFunc(timeout, func() {
+    vs.mu.Lock()
+    expired = true
+    vs.viewChanged.Broadcast()
+    vs.mu.Unlock()
+  })
+  defer timer.Stop()
+
+  for vs.view.ViewNumber <= args.ViewNumber && ! expired && vs.dead == false {
+    vs.viewChanged.Wait()
+  }
+
+  reply.View = vs.view.clone()
+  reply.ServersAlive = copyServers(vs.serversAlive)
+  reply.Changed = vs.view.ViewNumber > args.ViewNumber
+
+  return nil
+}
+
 func (vs *ViewServer) Status(args *StatusArgs, reply *StatusReply) error {
   vs.mu.Lock()
   defer vs.mu.Unlock()
@@ -60,6 +175,13 @@ func (vs *ViewServer) Status(args *StatusArgs, reply *StatusReply) error {
   reply.PrimaryServers    = vs.primaryServers
   reply.RecoveryInProcess = vs.recoveryInProcess
   reply.RecoveryMasters   = vs.recoveryMasters
+  reply.Migrations        = vs.migrations
+  reply.ServerLoads       = vs.serverLoads
+  reply.LostSegments      = vs.lostSegments
+  reply.Draining          = vs.draining
+  reply.Decommissioned    = vs.decommissioned
+  reply.Recoveries        = vs.recoveryStatus()
+  reply.Domains           = vs.domains
 
   return nil
 }
@@ -69,95 +191,236 @@ func (vs *ViewServer) Ping(args *PingArgs, reply *PingReply) error {
   vs.mu.Lock()
   defer vs.mu.Unlock()
 
+  vs.catchUp(false)
+
+  // a server that sees the cluster differently can't be part of it
+  if args.ConfigDigest != "" && args.ConfigDigest != vs.configDigest {
+    if ! vs.badConfigs[args.ServerName] {
+      fmt.Printf("%s doesn't have the cluster's config; ignoring it\n", args.ServerName)
+      vs.badConfigs[args.ServerName] = true
+    }
+    reply.Err = ErrBadConfig
+    return nil
+  }
+  delete(vs.badConfigs, args.ServerName)
+
+  // a decommissioned server is out for good, unless it comes back as a new
+  // incarnation
+  if vs.decommissioned[args.ServerName] && vs.incarnations[args.ServerName] == args.Incarnation {
+    reply.Draining = copyServers(vs.draining)
+    return nil
+  }
+
   // update the last ping and liveness for the sender
   vs.serverPings[args.ServerName] = time.Now()
   vs.serversAlive[args.ServerName] = true
+  vs.serverLoads[args.ServerName] = args.Load
+  vs.pinged[args.ServerName] = args.Incarnation
+  if args.Domain != "" {
+    vs.domains[args.ServerName] = args.Domain
+  }
+
+  // a new incarnation doesn't get to act on the view until tick has dealt
+  // with whatever its predecessor left behind
+  if vs.incarnations[args.ServerName] == args.Incarnation {
+    reply.View = vs.view.clone()
+  }
+  reply.ServersAlive = copyServers(vs.serversAlive)
+  reply.Draining = copyServers(vs.draining)
+  reply.Domains = make(map[string]string)
+  for server, domain := range vs.domains {
+    reply.Domains[server] = domain
+  }
 
-  reply.View = vs.view
-  reply.ServersAlive = vs.serversAlive
+  // only the leader decides when a server is dead, so only its leases count
+  if vs.leading && vs.incarnations[args.ServerName] == args.Incarnation {
+    vs.leases[args.ServerName] = time.Now().Add(vs.config.LeaseTime())
+    reply.Lease = vs.config.LeaseTime()
+  }
 
+  reply.Err = OK
   return nil
 
 }
 
 
+// replies are encoded after vs.mu is let go, so they get copies of the sets
+// of servers that Ping and tick keep changing
+func copyServers(servers map[string]bool) map[string]bool {
+  c := make(map[string]bool)
+  for server, in := range servers {
+    c[server] = in
+  }
+  return c
+}
+
+
+// lets higher-numbered replicas know we're still around
+func (vs *ViewServer) Heartbeat(args *HeartbeatArgs, reply *HeartbeatReply) error {
+  if args.ConfigDigest != vs.configDigest {
+    return fmt.Errorf("replica %s has a different config", vs.me)
+  }
+  return nil
+}
+
+
 // tick cleans data structures, manages critical mass, updates views, and launches recovery
 func (vs *ViewServer) tick() {
+  vs.heartbeat()
+
   vs.mu.Lock()
 
-  newFailures := make(map[string][]int)
+  vs.catchUp(true)
+
+  leader := vs.isLeader()
+  if leader && ! vs.leading {
+    // give servers a chance to check in before deciding which in-flight
+    // recoveries have lost their recovery master.
+    fmt.Println("Viewservice replica leading ", vs.me)
+    vs.startTime = time.Now()
+    vs.resuming = len(vs.recoveryInProcess) > 0
+  }
+  vs.leading = leader
 
-  // keep track of the need for an intermediate view
-  intermediateView := false
+  failed := make([]string, 0)
 
   // liveness check
   for server, lastPingTime := range vs.serverPings {
-    if time.Since(lastPingTime) >= PING_INTERVAL * DEAD_PINGS {
+    if time.Since(lastPingTime) >= vs.config.DeadTime() {
 
       // are we already working on recovering this guy?
+      // (its recovery masters are watched separately, below)
       _, inProcess := vs.recoveryInProcess[server]
       if inProcess {
-        // TODO: see if the recovery master is also alive?
         continue
       }
 
-      // record recovery information
-      shardsOwned := make([]int, 0)
+      delete(vs.serversAlive, server)
 
-      // based on previous view, which shards do we need to recover?
-      for shard, primary := range vs.view.ShardsToPrimaries {
+      // it may still be serving its shards
+      if vs.leaseHeld(server) {
+        continue
+      }
+
+      // based on previous view, do we need to recover anything?
+      for _, primary := range vs.view.ShardsToPrimaries {
         if primary == server {
-          shardsOwned = append(shardsOwned, shard)
-          delete(vs.view.ShardsToPrimaries, shard)
-          intermediateView = true
+          failed = append(failed, server)
+          break
         }
       }
+    }
+  }
 
-      if len(shardsOwned) > 0 {
-        newFailures[server]          = shardsOwned
-        vs.recoveryInProcess[server] = shardsOwned
-      }
+  // only the leading replica makes decisions; the rest just follow the log
+  if ! vs.leading {
+    vs.mu.Unlock()
+    return
+  }
 
-      delete(vs.serversAlive, server)
+  newFailures := make(map[string][]int)
+  if len(failed) > 0 {
+    var err Err
+    newFailures, err = vs.commit(JournalEntry{Type: FailuresEntry, Failures: failed})
+    if err != OK {
+      vs.mu.Unlock()
+      return
+    }
+  }
+
+  // servers that came up as a new incarnation; a restart is a failure of the
+  // old one. no need to wait out the old one's lease: it's gone, and its
+  // successor doesn't get a lease until this is dealt with.
+  incarnations := make(map[string]int64)
+  for server, incarnation := range vs.pinged {
+    known, ok := vs.incarnations[server]
+    if vs.serversAlive[server] && known != incarnation && (ok || incarnation != 0) {
+      incarnations[server] = incarnation
+    }
+  }
+  if len(incarnations) > 0 {
+    restarted, err := vs.commit(JournalEntry{Type: IncarnationsEntry, Incarnations: incarnations})
+    if err != OK {
+      vs.mu.Unlock()
+      return
+    }
+    for server, shards := range restarted {
+      fmt.Printf("Server %s restarted; recovering its shards\n", server)
+      newFailures[server] = shards
     }
   }
 
   if ! vs.criticalMassReached {
 
-    if len(vs.serversAlive) >= CRITICAL_MASS {
+    if len(vs.serversAlive) >= vs.config.CriticalMass {
 
+      primaryServers := make(map[string] bool)
       for server, _ := range vs.serversAlive {
-        vs.primaryServers[server] = true
+        primaryServers[server] = true
       }
 
-      primaryServersSlice := make([]string, len(vs.primaryServers))
+      primaryServersSlice := make([]string, len(primaryServers))
 
       i := 0
-      for primaryServer, _ := range vs.primaryServers {
+      for primaryServer, _ := range primaryServers {
         primaryServersSlice[i] = primaryServer
         i++
       }
 
       sort.Strings(primaryServersSlice)
 
-      // create an initial view with shards distributed round-robin
-      vs.view = View{ViewNumber: 1, ShardsToPrimaries: make(map[int] string)}
+      // create an initial view with shards distributed round-robin, taking
+      // turns between failure domains, big servers getting more turns
+      view := View{ViewNumber: 1, ShardsToPrimaries: vs.initialPlacement(primaryServersSlice)}
+      view.NumberOfShards = vs.config.NumberOfShards
+      if vs.config.RangePartitioned {
+        view.Ranges = initialRanges(vs.config.NumberOfShards)
+      }
 
-      for c := 0; c < NUMBER_OF_SHARDS; c++ {
-        vs.view.ShardsToPrimaries[c] = primaryServersSlice[c % len(primaryServersSlice)]
+      _, err := vs.commit(JournalEntry{Type: CriticalMassEntry, View: view, PrimaryServers: primaryServers})
+      if err != OK {
+        vs.mu.Unlock()
+        return
       }
 
       fmt.Println("Reached critical mass ", vs.primaryServers)
-      vs.criticalMassReached = true
     }
 
     vs.mu.Unlock()
     return
   }
 
-  // if switched to an intermediate view, increment the ViewNumber
-  if intermediateView {
-    vs.view.ViewNumber++
+  if vs.resuming && time.Since(vs.startTime) >= vs.config.DeadTime() {
+    vs.resuming = false
+  }
+
+  for _, shards := range newFailures {
+    for _, shard := range shards {
+      vs.assigning[shard] = true
+    }
+  }
+
+  // hand the shards of recovery masters that died or got stuck to somebody else
+  orphans := make(map[string][]int)
+  if ! vs.resuming {
+    orphans = vs.orphanedShards()
+  }
+  for _, shards := range orphans {
+    for _, shard := range shards {
+      vs.assigning[shard] = true
+    }
+  }
+
+  // empty out draining servers, then spread shards onto servers that joined
+  // late or are carrying too little
+  if len(vs.recoveryInProcess) == 0 && len(vs.migrations) == 0 && time.Now().After(vs.rebalanceAfter) {
+    if ! vs.drainStep() {
+      shard, from, to, ok := vs.pickMove()
+      if ok {
+        vs.migrations[shard] = to
+        go vs.migrate(shard, from, to)
+      }
+    }
   }
 
   vs.mu.Unlock()
@@ -167,6 +430,575 @@ func (vs *ViewServer) tick() {
     go vs.recover(newFailures)
   }
 
+  if len(orphans) > 0 {
+    fmt.Println("Reassigning recovery ", orphans)
+    go vs.recover(orphans)
+  }
+
+}
+
+
+// shards still being recovered whose recovery master is unknown, dead, failed
+// to take the job, or hasn't made progress in a long time. those recovery
+// masters are passed over for a while. callers must hold vs.mu.
+func (vs *ViewServer) orphanedShards() map[string][]int {
+  orphans := make(map[string][]int)
+
+  for rm, shards := range vs.recoveryMasters {
+
+    lastProgress, ok := vs.recoveryProgress[rm]
+    if ! ok {
+      // e.g. assigned by another replica; start the clock now
+      vs.recoveryProgress[rm] = time.Now()
+      lastProgress = vs.recoveryProgress[rm]
+    }
+
+    reason := ""
+    if ! vs.serversAlive[rm] {
+      reason = "is dead"
+    } else if vs.failedRecoveryMasters[rm] {
+      reason = "failed"
+    } else if time.Since(lastProgress) >= RECOVERY_TIMEOUT {
+      reason = "timed out"
+    }
+
+    if reason == "" {
+      continue
+    }
+
+    // shards already on their way to a new recovery master stay with it
+    pending := make([]int, 0)
+    for shard, _ := range shards {
+      if ! vs.assigning[shard] {
+        pending = append(pending, shard)
+      }
+    }
+    if len(pending) == 0 {
+      continue
+    }
+
+    fmt.Printf("Recovery master %s %s; reassigning its shards\n", rm, reason)
+
+    vs.excludedRecoveryMasters[rm] = time.Now()
+    delete(vs.failedRecoveryMasters, rm)
+    delete(vs.recoveryProgress, rm)
+
+    for _, shard := range pending {
+      server := vs.deadOwner(shard)
+      orphans[server] = append(orphans[server], shard)
+    }
+  }
+
+  // shards that never got a recovery master at all. recoveries we declined
+  // for lack of segments are retried once a missing backup would have had
+  // time to check in.
+  for server, shards := range vs.recoveryInProcess {
+    refusedAt, refused := vs.refusedAt[server]
+    if refused && time.Since(refusedAt) < vs.config.DeadTime() {
+      continue
+    }
+    for _, shard := range shards {
+      if vs.assigning[shard] {
+        continue
+      }
+      assigned := false
+      for _, rmShards := range vs.recoveryMasters {
+        if rmShards[shard] {
+          assigned = true
+          break
+        }
+      }
+      if ! assigned {
+        orphans[server] = append(orphans[server], shard)
+      }
+    }
+  }
+
+  return orphans
+}
+
+
+// whether server may still think it's the primary for its shards. a new
+// leader doesn't know what leases its predecessor granted, so it assumes
+// everyone holds one for a while. callers must hold vs.mu.
+func (vs *ViewServer) leaseHeld(server string) bool {
+  now := time.Now()
+  if now.Before(vs.leases[server]) {
+    return true
+  }
+  return now.Before(vs.startTime.Add(vs.config.LeaseTime()))
+}
+
+
+// the dead primary a shard under recovery used to belong to.
+// callers must hold vs.mu.
+func (vs *ViewServer) deadOwner(shard int) string {
+  for server, shards := range vs.recoveryInProcess {
+    for _, s := range shards {
+      if s == shard {
+        return server
+      }
+    }
+  }
+  return ""
+}
+
+
+// durably records entry and applies it. when replicated, the entry is first
+// agreed on by a majority of replicas; vs.mu is let go while waiting for
+// them, and ErrNoMajority is returned if they don't agree within
+// COMMIT_TIMEOUT. the entry may still make it into the log after that.
+// callers must hold vs.mu.
+func (vs *ViewServer) commit(entry JournalEntry) (map[string][]int, Err) {
+  entry.Time = time.Now()
+
+  if vs.px == nil {
+    vs.journal.append(entry)
+    newFailures := vs.apply(entry)
+    vs.compactJournal()
+    return newFailures, OK
+  }
+
+  entry.ID = rand.Int63()
+  pending := &pendingEntry{}
+  vs.pending[entry.ID] = pending
+  defer delete(vs.pending, entry.ID)
+
+  // keep proposing until our entry lands in the log, applying whatever
+  // other replicas got in ahead of it. somebody else may apply ours while
+  // we wait.
+  deadline := time.Now().Add(COMMIT_TIMEOUT)
+  for vs.dead == false && ! pending.applied && time.Now().Before(deadline) {
+    seq := vs.applied
+    vs.px.Start(seq, entry)
+    decided, ok := vs.waitDecided(seq, deadline)
+    if ok {
+      vs.applyDecided(seq, decided)
+    }
+  }
+
+  if ! pending.applied {
+    fmt.Println("No majority of replicas agreed on a journal entry; giving up.")
+    return make(map[string][]int), ErrNoMajority
+  }
+  return pending.newFailures, OK
+}
+
+
+// waits for log entry seq to be decided, letting go of vs.mu in the
+// meantime. returns false if it wasn't by the deadline, or if somebody else
+// applied it while we weren't holding vs.mu. callers must hold vs.mu.
+func (vs *ViewServer) waitDecided(seq int, deadline time.Time) (JournalEntry, bool) {
+  to := 10 * time.Millisecond
+  for vs.dead == false && vs.applied == seq {
+    decided, v := vs.px.Status(seq)
+    if decided {
+      return v.(JournalEntry), true
+    }
+    if time.Now().After(deadline) {
+      break
+    }
+
+    vs.mu.Unlock()
+    time.Sleep(to)
+    vs.mu.Lock()
+
+    if to < time.Second {
+      to *= 2
+    }
+  }
+  return JournalEntry{}, false
+}
+
+
+// journals and applies the entry decided for seq. callers must hold vs.mu.
+func (vs *ViewServer) applyDecided(seq int, entry JournalEntry) map[string][]int {
+  entry.Seq = seq
+  vs.journal.append(entry)
+  newFailures := vs.apply(entry)
+  vs.applied = seq + 1
+  vs.px.Done(seq)
+  vs.compactJournal()
+
+  pending, ok := vs.pending[entry.ID]
+  if ok {
+    pending.applied = true
+    pending.newFailures = newFailures
+  }
+  return newFailures
+}
+
+
+// applies log entries decided since we last looked. if fill is set and a
+// gap has stayed undecided since the previous call, a no-op is proposed to
+// learn what was decided there. callers must hold vs.mu.
+func (vs *ViewServer) catchUp(fill bool) {
+  if vs.px == nil {
+    return
+  }
+
+  for vs.dead == false {
+    decided, v := vs.px.Status(vs.applied)
+    if decided {
+      vs.applyDecided(vs.applied, v.(JournalEntry))
+      continue
+    }
+
+    if ! fill || vs.applied > vs.px.Max() {
+      return
+    }
+
+    if vs.stalled != vs.applied {
+      // maybe somebody is still working on it; check again next tick
+      vs.stalled = vs.applied
+      return
+    }
+
+    seq := vs.applied
+    vs.px.Start(seq, JournalEntry{Type: NoOpEntry})
+    entry, ok := vs.waitDecided(seq, time.Now().Add(COMMIT_TIMEOUT))
+    if ! ok {
+      return
+    }
+    vs.applyDecided(seq, entry)
+  }
+}
+
+
+// the lowest-numbered replica that can still be heard from leads.
+// callers must hold vs.mu.
+func (vs *ViewServer) isLeader() bool {
+  for i := 0; i < vs.replica; i++ {
+    if time.Since(vs.lastHeard[i]) < vs.config.DeadTime() {
+      return false
+    }
+  }
+  return true
+}
+
+
+// check in with the lower-numbered replicas
+func (vs *ViewServer) heartbeat() {
+  for i := 0; i < vs.replica; i++ {
+    go func(i int) {
+      args := &HeartbeatArgs{ConfigDigest: vs.configDigest}
+      reply := &HeartbeatReply{}
+      if call(vs.replicas[i], "ViewServer.Heartbeat", vs.networkMode, args, reply) {
+        vs.mu.Lock()
+        vs.lastHeard[i] = time.Now()
+        vs.mu.Unlock()
+      }
+    }(i)
+  }
+}
+
+
+// applies a state transition to the view and recovery bookkeeping. returns
+// the shards of any servers newly declared dead. callers must hold vs.mu.
+func (vs *ViewServer) apply(entry JournalEntry) map[string][]int {
+
+  newFailures := make(map[string][]int)
+
+  // entries journaled before we kept track don't say when they happened
+  at := entry.Time
+  if at.IsZero() {
+    at = time.Now()
+  }
+
+  viewNumber := vs.view.ViewNumber
+  defer func() {
+    if vs.view.ViewNumber != viewNumber {
+      vs.viewChanged.Broadcast()
+      vs.record(Event{Time: at, Type: EventViewCreated, ViewNumber: vs.view.ViewNumber})
+    }
+  }()
+
+  switch entry.Type {
+
+  case SnapshotEntry:
+    snapshot := entry.Snapshot
+    vs.view = snapshot.View.clone()
+    vs.criticalMassReached = snapshot.CriticalMassReached
+    vs.primaryServers = make(map[string] bool)
+    for server, isPrimary := range snapshot.PrimaryServers {
+      vs.primaryServers[server] = isPrimary
+    }
+    vs.recoveryInProcess = make(map[string][]int)
+    for server, shards := range snapshot.RecoveryInProcess {
+      vs.recoveryInProcess[server] = shards
+    }
+    vs.recoveryMasters = make(map[string]map[int]bool)
+    for rm, shards := range snapshot.RecoveryMasters {
+      vs.recoveryMasters[rm] = shards
+    }
+    vs.incarnations = make(map[string]int64)
+    for server, incarnation := range snapshot.Incarnations {
+      vs.incarnations[server] = incarnation
+    }
+    vs.deadIncarnations = make(map[string]int64)
+    for server, incarnation := range snapshot.DeadIncarnations {
+      vs.deadIncarnations[server] = incarnation
+    }
+    vs.draining = make(map[string]bool)
+    for server, _ := range snapshot.Draining {
+      vs.draining[server] = true
+    }
+    vs.decommissioned = make(map[string]bool)
+    for server, _ := range snapshot.Decommissioned {
+      vs.decommissioned[server] = true
+    }
+    vs.applied = snapshot.AppliedSeq
+
+  case CriticalMassEntry:
+    if vs.criticalMassReached {
+      break
+    }
+    vs.view = entry.View.clone()
+    vs.primaryServers = copyServers(entry.PrimaryServers)
+    vs.criticalMassReached = true
+
+  case FailuresEntry:
+    // keep track of the need for an intermediate view
+    intermediateView := false
+
+    for _, server := range entry.Failures {
+      shardsOwned := vs.fail(server, vs.incarnations[server], at)
+      if len(shardsOwned) > 0 {
+        newFailures[server] = shardsOwned
+        intermediateView = true
+        vs.record(Event{Time: at, Type: EventServerDead, Server: server, Shards: shardsOwned})
+      }
+    }
+
+    // if switched to an intermediate view, increment the ViewNumber
+    if intermediateView {
+      vs.view.ViewNumber++
+    }
+
+  case IncarnationsEntry:
+    intermediateView := false
+
+    for server, incarnation := range entry.Incarnations {
+      old, known := vs.incarnations[server]
+      vs.incarnations[server] = incarnation
+      if ! known || old == incarnation {
+        continue
+      }
+
+      // starts over as an ordinary server
+      delete(vs.draining, server)
+      delete(vs.decommissioned, server)
+
+      // whatever the old incarnation held is gone
+      shardsOwned := vs.fail(server, old, at)
+      if len(shardsOwned) > 0 {
+        newFailures[server] = shardsOwned
+        intermediateView = true
+      }
+      vs.record(Event{Time: at, Type: EventServerRestarted, Server: server, Shards: shardsOwned})
+    }
+
+    if intermediateView {
+      vs.view.ViewNumber++
+    }
+
+  case RecoveryMastersEntry:
+    for recoveryMaster, recoveryShards := range entry.Assignments {
+      for _, shard := range recoveryShards {
+
+        // a shard has at most one recovery master at a time
+        for rm, shards := range vs.recoveryMasters {
+          delete(shards, shard)
+          if len(shards) == 0 {
+            delete(vs.recoveryMasters, rm)
+          }
+        }
+
+        // keep track of shards that this guy is supposed to recover
+        shards, ok := vs.recoveryMasters[recoveryMaster]
+        if ! ok {
+          shards = make(map[int]bool)
+        }
+        shards[shard] = true
+        vs.recoveryMasters[recoveryMaster] = shards
+
+        vs.startShardRecovery(shard, recoveryMaster, at)
+      }
+
+      vs.record(Event{Time: at, Type: EventRecoveryMasterElected, RecoveryMaster: recoveryMaster, Shards: recoveryShards})
+    }
+
+  case RecoveryCompletedEntry:
+    shards, ok := vs.recoveryMasters[entry.Server]
+    if ! ok || ! shards[entry.Shard] {
+      break
+    }
+
+    delete(shards, entry.Shard)
+    if len(shards) == 0 {
+      delete(vs.recoveryMasters, entry.Server)
+    }
+
+    dead := vs.deadOwner(entry.Shard)
+    vs.finishShardRecovery(dead, entry, at)
+
+    for server, inProcess := range vs.recoveryInProcess {
+      remaining := make([]int, 0)
+      for _, shard := range inProcess {
+        if shard != entry.Shard {
+          remaining = append(remaining, shard)
+        }
+      }
+      if len(remaining) == 0 {
+        delete(vs.recoveryInProcess, server)
+        delete(vs.deadIncarnations, server)
+        vs.recoveryDone(server, at)
+      } else {
+        vs.recoveryInProcess[server] = remaining
+      }
+    }
+
+    vs.view.ShardsToPrimaries[entry.Shard] = entry.Server
+    vs.view.ViewNumber++
+
+  case DrainEntry:
+    vs.draining[entry.Server] = true
+    vs.record(Event{Time: at, Type: EventServerDraining, Server: entry.Server})
+
+  case DecommissionedEntry:
+    delete(vs.draining, entry.Server)
+    delete(vs.serversAlive, entry.Server)
+    vs.decommissioned[entry.Server] = true
+    vs.record(Event{Time: at, Type: EventServerDecommissioned, Server: entry.Server})
+
+  case ShardMovedEntry:
+    primary, ok := vs.view.ShardsToPrimaries[entry.Shard]
+    if ! ok || primary != entry.From {
+      break
+    }
+
+    vs.view.ShardsToPrimaries[entry.Shard] = entry.Server
+    vs.view.ViewNumber++
+    vs.record(Event{Time: at, Type: EventShardMoved, Server: entry.Server, From: entry.From, Shards: []int{entry.Shard}})
+
+  case ShardSplitEntry:
+    shards := vs.splitShard(entry.Shard, entry.Key)
+    if shards != nil {
+      vs.view.ViewNumber++
+      vs.record(Event{Time: at, Type: EventShardSplit, Server: vs.view.ShardsToPrimaries[entry.Shard], Shards: shards})
+    }
+
+  case ShardsMergedEntry:
+    shards := vs.mergeShards(entry.Shard)
+    if shards != nil {
+      vs.view.ViewNumber++
+      vs.record(Event{Time: at, Type: EventShardsMerged, Server: vs.view.ShardsToPrimaries[shards[0]], Shards: shards})
+    }
+
+  }
+
+  return newFailures
+}
+
+
+// takes the shards of a dead incarnation of server out of the view and
+// marks them for recovery. returns the shards, if any; the caller bumps the
+// view number. callers must hold vs.mu.
+func (vs *ViewServer) fail(server string, incarnation int64, at time.Time) []int {
+
+  // are we already working on recovering this guy?
+  _, inProcess := vs.recoveryInProcess[server]
+  if inProcess {
+    return nil
+  }
+
+  // based on previous view, which shards do we need to recover?
+  shardsOwned := make([]int, 0)
+  for shard, primary := range vs.view.ShardsToPrimaries {
+    if primary == server {
+      shardsOwned = append(shardsOwned, shard)
+      delete(vs.view.ShardsToPrimaries, shard)
+    }
+  }
+
+  // a new incarnation under the same name; what we reported about the last
+  // one is no longer news
+  vs.forgetRecovery(server)
+
+  if len(shardsOwned) > 0 {
+    vs.recoveryInProcess[server] = shardsOwned
+    vs.deadIncarnations[server]  = incarnation
+    vs.recoveries[server] = make(map[int]*ShardRecovery)
+    vs.failedAt[server] = at
+  }
+  return shardsOwned
+}
+
+
+// current durable state, for compacting the journal. callers must hold vs.mu.
+func (vs *ViewServer) snapshot() Snapshot {
+  snapshot := Snapshot{}
+  snapshot.View = vs.view
+  snapshot.CriticalMassReached = vs.criticalMassReached
+  snapshot.PrimaryServers = vs.primaryServers
+  snapshot.RecoveryInProcess = vs.recoveryInProcess
+  snapshot.RecoveryMasters = vs.recoveryMasters
+  snapshot.Incarnations = vs.incarnations
+  snapshot.DeadIncarnations = vs.deadIncarnations
+  snapshot.Draining = vs.draining
+  snapshot.Decommissioned = vs.decommissioned
+  snapshot.AppliedSeq = vs.applied
+  return snapshot
+}
+
+
+// starts the journal over from a snapshot once it has grown long, so that a
+// restart doesn't have to replay all of it. callers must hold vs.mu.
+func (vs *ViewServer) compactJournal() {
+  if vs.journal.file == nil || vs.journal.entries < SNAPSHOT_EVERY {
+    return
+  }
+  old := vs.journal
+  vs.journal = startJournal(old.path, vs.snapshot())
+  old.close()
+}
+
+
+// rebuild state from the journal left behind by a previous incarnation
+func (vs *ViewServer) restore() {
+  fname := JournalName(vs.me)
+
+  entries := readJournal(fname)
+  vs.replaying = true
+  for _, entry := range entries {
+    vs.apply(entry)
+    if vs.px != nil && entry.Type != SnapshotEntry {
+      vs.applied = entry.Seq + 1
+    }
+  }
+  vs.replaying = false
+
+  if len(entries) > 0 {
+    fmt.Printf("Restored view %d from journal (%d entries)\n", vs.view.ViewNumber, len(entries))
+
+    // we haven't heard from anybody yet. servers that don't check in soon
+    // are treated as dead.
+    for _, primary := range vs.view.ShardsToPrimaries {
+      vs.serverPings[primary] = vs.startTime
+    }
+    for server, _ := range vs.primaryServers {
+      vs.serverPings[server] = vs.startTime
+    }
+    for rm, _ := range vs.recoveryMasters {
+      vs.serverPings[rm] = vs.startTime
+    }
+
+    if vs.px != nil {
+      vs.px.Done(vs.applied - 1)
+    }
+  }
+
+  vs.journal = startJournal(fname, vs.snapshot())
 }
 
 
@@ -183,10 +1015,44 @@ func (vs *ViewServer) recover(deadPrimaries map[string][]int) {
     serversAliveCpy[i] = serverAlive
     i++
   }
-  vs.mu.Unlock()
+
+  // don't hand recovery back to servers that just failed at it, or to
+  // restarted servers whose old incarnation is being recovered
+  candidates := make([]string, 0)
+  for _, server := range serversAliveCpy {
+    excludedAt, excluded := vs.excludedRecoveryMasters[server]
+    _, restarted := deadPrimaries[server]
+    if (! excluded || time.Since(excludedAt) >= RECOVERY_TIMEOUT) && ! restarted && ! vs.draining[server] {
+      candidates = append(candidates, server)
+    }
+  }
+  if len(candidates) == 0 {
+    candidates = serversAliveCpy
+  }
+
+  // whatever took out the dead primaries may take out their neighbours too
+  deadDomains := make(map[string]bool)
+  for dead, _ := range deadPrimaries {
+    deadDomains[vs.domainOf(dead)] = true
+  }
+  elsewhere := make([]string, 0)
+  for _, server := range candidates {
+    if ! deadDomains[vs.domainOf(server)] {
+      elsewhere = append(elsewhere, server)
+    }
+  }
+  if len(elsewhere) > 0 {
+    candidates = elsewhere
+  }
 
   querySegArgs := QuerySegmentsArgs{}
   querySegArgs.DeadPrimaries = deadPrimaries
+  querySegArgs.Incarnations = make(map[string]int64)
+  for dead, _ := range deadPrimaries {
+    querySegArgs.Incarnations[dead] = vs.deadIncarnations[dead]
+  }
+  querySegArgs.ViewNumber = vs.view.ViewNumber
+  vs.mu.Unlock()
 
   var wg sync.WaitGroup
 
@@ -209,15 +1075,24 @@ func (vs *ViewServer) recover(deadPrimaries map[string][]int) {
   // for each shard, which segments does it need and where are they each located?
   shrdToSegToSrv := make(map[int]map[int64][]string)
 
+  // and for each dead primary, all of them
+  ownerToSegToSrv := make(map[string]map[int64][]string)
+
   // run through replies from potential backups and figure out what useful data each has
   for i:=0; i < numLiveServers; i++ {
 
     if acks[i] {
 
-      for _, segsToShards := range queryReplies[i].BackedUpSegments {
+      for dead, segsToShards := range queryReplies[i].BackedUpSegments {
 
         for segment, shards := range segsToShards {
 
+          _, deadok := ownerToSegToSrv[dead]
+          if ! deadok {
+            ownerToSegToSrv[dead] = make(map[int64][]string)
+          }
+          ownerToSegToSrv[dead][segment] = append(ownerToSegToSrv[dead][segment], serversAliveCpy[i])
+
           for shard, _ := range shards {
 
             // make sure that all levels of shrdToSegToSrv are init'd
@@ -243,69 +1118,134 @@ func (vs *ViewServer) recover(deadPrimaries map[string][]int) {
 
   }
 
-  // TODO: check to make sure that list of shards is complete
-
-  // assign shards to recover to recovery masters
-  shardToAssign  := 0
+  // make sure that no part of a dead server's log went missing along with
+  // its backups before handing its shards out
+  vs.mu.Lock()
+  allowDataLoss := vs.allowDataLoss
+  vs.mu.Unlock()
 
-  // recovery master host -> shards to recover
-  recoveryMasters := make(map[string][]int)
+  recoverable := make(map[string][]int)
+  refused     := make(map[string][]int)
+  for dead, shards := range deadPrimaries {
+    missing := missingSegments(dead, queryReplies, acks)
+
+    vs.mu.Lock()
+    if len(missing) == 0 {
+      delete(vs.lostSegments, dead)
+      delete(vs.refusedAt, dead)
+    } else {
+      fmt.Printf("!!! %d log segments of %s are not on any live backup: %v\n", len(missing), dead, missing)
+      vs.lostSegments[dead] = missing
+    }
+    vs.mu.Unlock()
 
-  if len(serversAliveCpy) == 0 {
-    fmt.Println("No servers alive; nothing to do.")
-    return
+    if len(missing) > 0 && ! allowDataLoss {
+      refused[dead] = shards
+    } else {
+      recoverable[dead] = shards
+    }
   }
 
-  for _, shards := range deadPrimaries {
-
-    for _, shard := range shards {
-
-      // round robin assignment to recovery masters
-
-      // TODO: restrict number of RM's
-      // TODO: load balancing
+  if len(refused) > 0 {
+    fmt.Println("!!! refusing to recover shards that would lose data ", refused)
+    vs.mu.Lock()
+    for dead, shards := range refused {
+      vs.refusedAt[dead] = time.Now()
+      for _, shard := range shards {
+        delete(vs.assigning, shard)
+      }
+    }
+    vs.mu.Unlock()
+  }
 
-      recoveryMaster := serversAliveCpy[shardToAssign % len(serversAliveCpy)]
-      shardToAssign++
+  deadPrimaries = recoverable
+  if len(deadPrimaries) == 0 {
+    return
+  }
 
-      _, ok := recoveryMasters[recoveryMaster]
-      if ! ok {
-        recoveryMasters[recoveryMaster] = make([]int, 0)
+  if len(candidates) == 0 {
+    fmt.Println("No servers alive; nothing to do.")
+    vs.mu.Lock()
+    for _, shards := range deadPrimaries {
+      for _, shard := range shards {
+        delete(vs.assigning, shard)
       }
+    }
+    vs.mu.Unlock()
+    return
+  }
 
-      recoveryMasters[recoveryMaster] = append(recoveryMasters[recoveryMaster], shard)
+  shardsToAssign := make([]int, 0)
+  owners := make(map[int]string)
+  for dead, shards := range deadPrimaries {
+    shardsToAssign = append(shardsToAssign, shards...)
+    for _, shard := range shards {
+      owners[shard] = dead
     }
+  }
 
+  // recovery master host -> shards to recover
+  vs.mu.Lock()
+  recoveryMasters := vs.pickRecoveryMasters(candidates, shardsToAssign)
+  partitions := make(map[int]Partition)
+  for _, shard := range shardsToAssign {
+    partitions[shard] = vs.view.PartitionOf(shard)
   }
+  vs.mu.Unlock()
 
-  // TODO: record recovery masters for in-progress recoveries.
+  vs.mu.Lock()
+  var err Err = ErrNotLeader
+  if vs.leading {
+    // we may have been deposed while asking around
+    _, err = vs.commit(JournalEntry{Type: RecoveryMastersEntry, Assignments: recoveryMasters})
+  }
+  if err != OK {
+    // try again on a later tick
+    for _, shard := range shardsToAssign {
+      delete(vs.assigning, shard)
+    }
+    vs.mu.Unlock()
+    return
+  }
+  for recoveryMaster, recoveryShards := range recoveryMasters {
+    vs.recoveryTimes[recoveryMaster] = time.Now()
+    vs.recoveryProgress[recoveryMaster] = time.Now()
+    for _, shard := range recoveryShards {
+      delete(vs.assigning, shard)
+    }
+  }
+  vs.mu.Unlock()
 
   for recoveryMaster, recoveryShards := range recoveryMasters {
 
-    // relevant subset of shrdToSegToSrv
+    // relevant subset of shrdToSegToSrv. backups know ops by the shard they
+    // were in before any splits; a range of keys could be in any of them.
     recoveryData := make(map[int]map[int64][]string)
+    recoveryPartitions := make(map[int]Partition)
     for _, shard := range recoveryShards {
-      recoveryData[shard] = shrdToSegToSrv[shard]
-
-      // keep track of shards that this guy is supposed to recover
-      vs.mu.Lock()
-      shards, ok := vs.recoveryMasters[recoveryMaster]
-      if ! ok {
-        shards = make(map[int]bool)
+      if vs.config.RangePartitioned {
+        recoveryData[shard] = ownerToSegToSrv[owners[shard]]
+      } else {
+        recoveryData[shard] = shrdToSegToSrv[shard % vs.config.NumberOfShards]
       }
-      shards[shard] = true
-      vs.recoveryMasters[recoveryMaster] = shards
-      vs.recoveryTimes[recoveryMaster] = time.Now()
-      vs.mu.Unlock()
-
+      recoveryPartitions[shard] = partitions[shard]
     }
 
     electionArgs  := new(ElectRecoveryMasterArgs)
     electionReply := new(ElectRecoveryMasterReply)
     electionArgs.RecoveryData = recoveryData
     electionArgs.DeadPrimaries = deadPrimaries
+    electionArgs.Partitions = recoveryPartitions
 
-    go call(recoveryMaster, "PBServer.ElectRecoveryMaster", vs.networkMode, electionArgs, electionReply)
+    go func(recoveryMaster string) {
+      ok := call(recoveryMaster, "PBServer.ElectRecoveryMaster", vs.networkMode, electionArgs, electionReply)
+      if ! ok {
+        // tick will hand whatever it didn't finish to somebody else
+        vs.mu.Lock()
+        vs.failedRecoveryMasters[recoveryMaster] = true
+        vs.mu.Unlock()
+      }
+    }(recoveryMaster)
 
   }
 
@@ -314,30 +1254,86 @@ func (vs *ViewServer) recover(deadPrimaries map[string][]int) {
 }
 
 
+// ids of the segments in dead's log that no backup has. the longest digest
+// any backup has seen lists every segment up to the newest one that was
+// replicated. if no backup knows anything about dead, there is nothing to
+// check against.
+func missingSegments(dead string, replies []*QuerySegmentsReply, acks []bool) []int64 {
+  var newest []int64
+  found := make(map[int64]bool)
+
+  for i, reply := range replies {
+    if ! acks[i] {
+      continue
+    }
+    digest := reply.Digests[dead]
+    if len(digest) > len(newest) {
+      newest = digest
+    }
+    for segment, _ := range reply.BackedUpSegments[dead] {
+      found[segment] = true
+    }
+  }
+
+  missing := make([]int64, 0)
+  for _, segment := range newest {
+    if ! found[segment] {
+      missing = append(missing, segment)
+    }
+  }
+  return missing
+}
+
+
+// lets recovery go ahead for servers whose logs are missing segments,
+// restoring whatever survived. off by default.
+func (vs *ViewServer) SetAllowDataLoss(allow bool) {
+  vs.mu.Lock()
+  defer vs.mu.Unlock()
+  vs.allowDataLoss = allow
+}
+
+
 // updates the view after recovery of a shard is successful
 func (vs *ViewServer) RecoveryCompleted(args *RecoveryCompletedArgs, reply *RecoveryCompletedReply) error {
   vs.mu.Lock()
   defer vs.mu.Unlock()
 
+  vs.catchUp(false)
+
+  // a replica that only thinks it leads mustn't change the view
+  if ! vs.leading {
+    reply.Err = ErrNotLeader
+    return nil
+  }
+  reply.Err = OK
+
   fmt.Printf("Recovered shard %d from server %s \n", args.ShardRecovered, args.ServerName)
-  if args.DataRecieved > 0 {
+  _, timed := vs.recoveryTimes[args.ServerName]
+  if args.DataRecieved > 0 && timed {
     fmt.Println("-- recovery completed in ", time.Since(vs.recoveryTimes[args.ServerName]))
     fmt.Printf("-- recieved %f MB of data\n", float32(args.DataRecieved) / float32(1024 * 1024))
   }
 
   shards, ok := vs.recoveryMasters[args.ServerName]
-  if ! ok {
-    fmt.Println("Recovery master has no shards to recover. Should never happen.")
-    os.Exit(1)
+  if ! ok || ! shards[args.ShardRecovered] {
+    // recovery was handed to somebody else (e.g. after a viewservice restart)
+    fmt.Println("Recovery master was not assigned this shard; ignoring.")
+    return nil
   }
-
-  delete(shards, args.ShardRecovered)
-  if len(shards) == 0 {
-    delete(vs.recoveryMasters, args.ServerName)
+  if vs.assigning[args.ShardRecovered] {
+    // we gave up on this recovery master and are picking a new one
+    fmt.Println("Recovery master was replaced for this shard; ignoring.")
+    return nil
   }
 
-  vs.view.ShardsToPrimaries[args.ShardRecovered] = args.ServerName
-  vs.view.ViewNumber++
+  _, err := vs.commit(JournalEntry{Type: RecoveryCompletedEntry, Server: args.ServerName, Shard: args.ShardRecovered, Bytes: int64(args.DataRecieved)})
+  if err != OK {
+    // the recovery master times out, and the shard is recovered again
+    reply.Err = err
+    return nil
+  }
+  vs.recoveryProgress[args.ServerName] = time.Now()
 
   if len(vs.recoveryMasters) == 0 {
     fmt.Println("recovery complete!")
@@ -354,36 +1350,100 @@ func (vs *ViewServer) Kill() {
   vs.dead = true
   vs.l.Close()
 
+  if vs.px != nil {
+    vs.px.Kill()
+  }
+
+  vs.mu.Lock()
+  vs.journal.close()
+  if vs.events.file != nil {
+    vs.events.file.Close()
+    vs.events.file = nil
+  }
+  vs.viewChanged.Broadcast()
+  vs.mu.Unlock()
+
 }
 
 func StartServer(me string) *ViewServer {
-  return StartMe(me, "unix")
+  return StartMe(me, "unix", DefaultConfig())
+}
+
+// start a viewservice that runs as a single process
+func StartMe(me string, networkMode string, config Config) *ViewServer {
+  return StartReplica([]string{me}, 0, networkMode, config)
 }
 
 // start the server
 // actually modified, but just to add the modified fields, and it was getting annoying down below
-func StartMe(me string, networkMode string) *ViewServer {
+// replicas holds the addresses of every viewservice replica, replicas[me] is this one.
+func StartReplica(replicas []string, me int, networkMode string, config Config) *ViewServer {
+
+  gob.Register(JournalEntry{})
 
   vs := new(ViewServer)
-  vs.me = me
+  vs.me = replicas[me]
+  vs.config = config
+  vs.configDigest = config.Digest()
+  vs.badConfigs = make(map[string] bool)
 
   // set modified fields
   vs.view = View{}
+  vs.viewChanged = sync.NewCond(&vs.mu)
 
   vs.criticalMassReached = false
   vs.serverPings = make(map[string] time.Time)
   vs.serversAlive = make(map[string] bool)
+  vs.serverLoads = make(map[string] ServerLoad)
+  vs.domains = make(map[string] string)
   vs.primaryServers = make(map[string] bool)
   vs.recoveryInProcess = make(map[string][]int)
+  vs.incarnations = make(map[string] int64)
+  vs.pinged = make(map[string] int64)
+  vs.deadIncarnations = make(map[string] int64)
+  vs.leases = make(map[string] time.Time)
   vs.recoveryMasters = make(map[string]map[int]bool)
   vs.recoveryTimes = make(map[string] time.Time)
+  vs.policy = config.PlacementPolicy()
+  vs.recoveryProgress = make(map[string] time.Time)
+  vs.failedRecoveryMasters = make(map[string] bool)
+  vs.excludedRecoveryMasters = make(map[string] time.Time)
+  vs.assigning = make(map[int] bool)
+  vs.recoveries = make(map[string]map[int]*ShardRecovery)
+  vs.failedAt = make(map[string] time.Time)
+  vs.events = new(EventLog)
+  vs.lostSegments = make(map[string][]int64)
+  vs.refusedAt = make(map[string] time.Time)
+  vs.migrations = make(map[int]string)
+  vs.pinned = make(map[int]time.Time)
+  vs.draining = make(map[string] bool)
+  vs.handingOff = make(map[string] bool)
+  vs.decommissioned = make(map[string] bool)
 
   vs.networkMode = networkMode
 
+  vs.replicas = replicas
+  vs.replica = me
+  vs.stalled = -1
+  vs.pending = make(map[int64]*pendingEntry)
+  vs.lastHeard = make(map[int] time.Time)
+  for i := 0; i < me; i++ {
+    // assume the others are up until we hear otherwise
+    vs.lastHeard[i] = time.Now()
+  }
+
   // tell net/rpc about our RPC server and handlers.
   rpcs := rpc.NewServer()
   rpcs.Register(vs)
 
+  if len(replicas) > 1 {
+    vs.px = paxos.MakeDurable(replicas, me, rpcs, networkMode, PaxosName(vs.me))
+  }
+
+  // pick up where the last viewservice at this address left off
+  vs.startTime = time.Now()
+  vs.restore()
+
   hostname := vs.me
   if networkMode == "unix" {
     os.Remove(hostname)
@@ -414,7 +1474,7 @@ func StartMe(me string, networkMode string) *ViewServer {
       }
 
       if err != nil && vs.dead == false {
-        fmt.Printf("ViewServer(%v) accept: %v\n", me, err.Error())
+        fmt.Printf("ViewServer(%v) accept: %v\n", vs.me, err.Error())
         vs.Kill()
       }
     }
@@ -424,7 +1484,7 @@ func StartMe(me string, networkMode string) *ViewServer {
   go func() {
     for vs.dead == false {
       vs.tick()
-      time.Sleep(PING_INTERVAL)
+      time.Sleep(vs.config.PingInterval)
     }
   }()
   return vs
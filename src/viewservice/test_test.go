@@ -6,6 +6,8 @@ import "time"
 import "fmt"
 import "os"
 import "strconv"
+import "strings"
+import "sync"
 
 func check(t *testing.T, ck *Clerk, shardsToPrimaries map[int]string, n uint) {
   view, _ := ck.Get()
@@ -34,13 +36,14 @@ func Test1(t *testing.T) {
   runtime.GOMAXPROCS(4)
 
   vshost := port("v")
+  os.Remove(JournalName(vshost))
   vs := StartServer(vshost)
 
   ck := make([]*Clerk,CRITICAL_MASS+1)
 
   for i := 0; i < CRITICAL_MASS+1; i+= 1{
 
-  ck[i] = MakeClerk(port(strconv.Itoa(i)), vshost)
+  ck[i] = MakeClerk(port(strconv.Itoa(i)), vshost, "unix")
   }
   //
 
@@ -168,6 +171,1068 @@ func Test1(t *testing.T) {
 }
 
 
+func TestRestart(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  vshost := port("restart")
+  os.Remove(JournalName(vshost))
+  vs := StartServer(vshost)
+
+  ck := make([]*Clerk, CRITICAL_MASS)
+  stopped := make([]bool, CRITICAL_MASS)
+
+  for i := 0; i < CRITICAL_MASS; i++ {
+    ck[i] = MakeClerk(port("restart" + strconv.Itoa(i)), vshost, "unix")
+  }
+
+  for i := 0; i < len(ck); i++ {
+    go func(vi int){
+      for stopped[vi] == false {
+        ck[vi].Ping(0)
+        time.Sleep(PING_INTERVAL)
+      }
+    }(i)
+  }
+
+  fmt.Printf("Test: View survives viewservice restart ...\n")
+
+  time.Sleep(PING_INTERVAL*DEAD_PINGS)
+
+  before, _ := ck[1].Get()
+  if before.ViewNumber != 1 {
+    t.Fatalf("wanted viewnumber 1 before restart, got %v", before.ViewNumber)
+  }
+
+  vs.Kill()
+  vs = StartServer(vshost)
+
+  check(t, ck[1], before.ShardsToPrimaries, before.ViewNumber)
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Server that dies across a restart is noticed ...\n")
+
+  stopped[0] = true
+  vs.Kill()
+  vs = StartServer(vshost)
+
+  time.Sleep(PING_INTERVAL*DEAD_PINGS*3)
+
+  after, _ := ck[1].Get()
+  if after.ViewNumber != 2 {
+    t.Fatalf("wanted viewnumber 2, got %v", after.ViewNumber)
+  }
+  for s, p := range after.ShardsToPrimaries {
+    if p == ck[0].me {
+      t.Fatalf("dead server still primary for shard %d", s)
+    }
+  }
+
+  status := ck[1].Status()
+  if len(status.RecoveryInProcess[ck[0].me]) == 0 {
+    t.Fatalf("recovery of dead server not recorded")
+  }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: A long journal is started over from a snapshot ...\n")
+
+  vs.mu.Lock()
+  vs.journal.entries = SNAPSHOT_EVERY
+  vs.compactJournal()
+  vs.mu.Unlock()
+
+  entries := readJournal(JournalName(vshost))
+  if len(entries) != 1 || entries[0].Type != SnapshotEntry {
+    t.Fatalf("compacted journal has %d entries", len(entries))
+  }
+
+  vs.Kill()
+  vs = StartServer(vshost)
+  check(t, ck[1], after.ShardsToPrimaries, after.ViewNumber)
+  fmt.Printf("  ... Passed\n")
+
+  for i := 0; i < len(ck); i++ {
+    stopped[i] = true
+  }
+  vs.Kill()
+}
+
+
+
+func TestRestartedServer(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  vshost := port("incarnation")
+  os.Remove(JournalName(vshost))
+  vs := StartServer(vshost)
+
+  ck := make([]*Clerk, CRITICAL_MASS)
+  stopped := make([]bool, CRITICAL_MASS)
+
+  for i := 0; i < CRITICAL_MASS; i++ {
+    ck[i] = MakeClerk(port("incarnation" + strconv.Itoa(i)), vshost, "unix")
+    ck[i].SetIncarnation(1)
+  }
+
+  for i := 0; i < len(ck); i++ {
+    go func(vi int){
+      for stopped[vi] == false {
+        ck[vi].Ping(0)
+        time.Sleep(PING_INTERVAL)
+      }
+    }(i)
+  }
+
+  fmt.Printf("Test: Restarted primary treated as dead ...\n")
+
+  time.Sleep(PING_INTERVAL*DEAD_PINGS)
+
+  before, _ := ck[1].Get()
+  owned := 0
+  for _, p := range before.ShardsToPrimaries {
+    if p == ck[0].me {
+      owned++
+    }
+  }
+  if before.ViewNumber != 1 || owned == 0 {
+    t.Fatalf("wanted ck[0] to be a primary in view 1; view %v, %d shards", before.ViewNumber, owned)
+  }
+
+  // comes back under the same name well before it would be missed
+  ck[0].SetIncarnation(2)
+  time.Sleep(PING_INTERVAL*5)
+
+  after, _ := ck[1].Get()
+  if after.ViewNumber <= before.ViewNumber {
+    t.Fatalf("restart didn't make a new view")
+  }
+  for s, p := range after.ShardsToPrimaries {
+    if p == ck[0].me {
+      t.Fatalf("restarted server still primary for shard %d", s)
+    }
+  }
+
+  status := ck[1].Status()
+  if len(status.RecoveryInProcess[ck[0].me]) != owned {
+    t.Fatalf("wanted %d shards of the old incarnation in recovery, got %v", owned, status.RecoveryInProcess[ck[0].me])
+  }
+  if ! status.ServersAlive[ck[0].me] {
+    t.Fatalf("new incarnation should be alive")
+  }
+
+  view, _, _ := ck[0].Ping(0)
+  if view.ViewNumber != after.ViewNumber {
+    t.Fatalf("new incarnation should get the view once it's been dealt with")
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  for i := 0; i < len(ck); i++ {
+    stopped[i] = true
+  }
+  vs.Kill()
+}
+
+func TestWatchView(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  vshost := port("watch")
+  os.Remove(JournalName(vshost))
+  vs := StartServer(vshost)
+
+  ck := make([]*Clerk, CRITICAL_MASS)
+  stopped := make([]bool, CRITICAL_MASS)
+  var mu sync.Mutex    // stopped and the subscriber's state are shared with goroutines
+  isStopped := func(i int) bool {
+    mu.Lock()
+    defer mu.Unlock()
+    return stopped[i]
+  }
+  stop := func(i int) {
+    mu.Lock()
+    stopped[i] = true
+    mu.Unlock()
+  }
+
+  for i := 0; i < CRITICAL_MASS; i++ {
+    ck[i] = MakeClerk(port("watch" + strconv.Itoa(i)), vshost, "unix")
+  }
+
+  fmt.Printf("Test: Watch times out without a new view ...\n")
+
+  start := time.Now()
+  view, _, ok := ck[0].WatchView(0, PING_INTERVAL)
+  if ! ok || view.ViewNumber != 0 {
+    t.Fatalf("watch failed or saw a view too soon; ok=%v view=%v", ok, view.ViewNumber)
+  }
+  if time.Since(start) < PING_INTERVAL {
+    t.Fatalf("watch returned before its timeout")
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Subscribers hear about each new view ...\n")
+
+  views := make(chan View, 10)
+  ck[1].Subscribe(0, func() bool { return false }, func(view View, serversAlive map[string]bool) bool {
+    views <- view
+    return view.ViewNumber < 2
+  })
+
+  for i := 0; i < len(ck); i++ {
+    go func(vi int){
+      for isStopped(vi) == false {
+        ck[vi].Ping(0)
+        time.Sleep(PING_INTERVAL)
+      }
+    }(i)
+  }
+
+  for want := uint(1); want <= 2; want++ {
+    select {
+    case view := <-views:
+      if view.ViewNumber != want {
+        t.Fatalf("wanted viewnumber %v, got %v", want, view.ViewNumber)
+      }
+      current, _ := ck[2].Get()
+      if current.ViewNumber != view.ViewNumber {
+        t.Fatalf("subscriber saw %v but current view is %v", view.ViewNumber, current.ViewNumber)
+      }
+    case <-time.After(PING_INTERVAL * DEAD_PINGS * 3):
+      t.Fatalf("no view %v within %v", want, PING_INTERVAL * DEAD_PINGS * 3)
+    }
+
+    // a failure makes the next view
+    stop(0)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Subscribers stop when done, even without a viewservice ...\n")
+
+  checks := 0
+  quit := false
+  ck[2].Subscribe(0, func() bool {
+    mu.Lock()
+    defer mu.Unlock()
+    checks++
+    return quit
+  }, func(view View, serversAlive map[string]bool) bool {
+    return true
+  })
+
+  for i := 0; i < len(ck); i++ {
+    stop(i)
+  }
+  vs.Kill()
+
+  time.Sleep(3 * PING_INTERVAL)
+  mu.Lock()
+  quit = true
+  mu.Unlock()
+  time.Sleep(WATCH_TIMEOUT)
+  mu.Lock()
+  before := checks
+  mu.Unlock()
+  time.Sleep(3 * PING_INTERVAL)
+  mu.Lock()
+  after := checks
+  mu.Unlock()
+  if before == 0 || after != before {
+    t.Fatalf("subscriber still running after done: %d checks, then %d", before, after)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestEventLog(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  vshost := port("events")
+  eventlog := JournalName(vshost) + ".events"
+  os.Remove(JournalName(vshost))
+  os.Remove(eventlog)
+  vs := StartServer(vshost)
+  vs.SetEventLog(eventlog)
+
+  ck := make([]*Clerk, CRITICAL_MASS)
+  stopped := make([]bool, CRITICAL_MASS)
+
+  for i := 0; i < CRITICAL_MASS; i++ {
+    ck[i] = MakeClerk(port("events" + strconv.Itoa(i)), vshost, "unix")
+  }
+
+  for i := 0; i < len(ck); i++ {
+    go func(vi int){
+      for stopped[vi] == false {
+        ck[vi].Ping(0)
+        time.Sleep(PING_INTERVAL)
+      }
+    }(i)
+  }
+
+  fmt.Printf("Test: Failures show up in the event log ...\n")
+
+  time.Sleep(PING_INTERVAL*DEAD_PINGS)
+  stopped[0] = true
+  time.Sleep(PING_INTERVAL*DEAD_PINGS*3)
+
+  events := ck[1].Events(-1)
+  views, dead := 0, 0
+  for i, event := range events {
+    if i > 0 && event.Seq <= events[i-1].Seq {
+      t.Fatalf("events out of order: %v after %v", event, events[i-1])
+    }
+    switch event.Type {
+    case EventViewCreated:
+      views++
+    case EventServerDead:
+      if event.Server != ck[0].me || len(event.Shards) == 0 {
+        t.Fatalf("wanted %s dead with some shards, got %v", ck[0].me, event)
+      }
+      dead++
+    }
+  }
+  if views < 2 || dead != 1 {
+    t.Fatalf("wanted at least 2 views and 1 death, got %d and %d: %v", views, dead, events)
+  }
+
+  last := events[len(events)-1].Seq
+  if len(ck[1].Events(last)) != 0 {
+    t.Fatalf("events after the last one")
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Event log survives viewservice restart ...\n")
+
+  vs.Kill()
+  vs = StartServer(vshost)
+  vs.SetEventLog(eventlog)
+
+  again := ck[1].Events(-1)
+  if len(again) < len(events) {
+    t.Fatalf("wanted %d events after restart, got %d", len(events), len(again))
+  }
+  for i, event := range events {
+    if again[i].Seq != event.Seq || again[i].Type != event.Type || again[i].Server != event.Server {
+      t.Fatalf("event %d changed across restart: %v, was %v", i, again[i], event)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  for i := 0; i < len(ck); i++ {
+    stopped[i] = true
+  }
+  vs.Kill()
+  os.Remove(eventlog)
+}
+
+
+func TestReplicated(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  nreplicas := 3
+  replicas := make([]string, nreplicas)
+  for i := 0; i < nreplicas; i++ {
+    replicas[i] = port("replica" + strconv.Itoa(i))
+    os.Remove(JournalName(replicas[i]))
+    os.Remove(PaxosName(replicas[i]))
+  }
+
+  vsa := make([]*ViewServer, nreplicas)
+  for i := 0; i < nreplicas; i++ {
+    vsa[i] = StartReplica(replicas, i, "unix", DefaultConfig())
+  }
+
+  vshost := strings.Join(replicas, ",")
+
+  ck := make([]*Clerk, CRITICAL_MASS)
+  stopped := make([]bool, CRITICAL_MASS)
+  var mu sync.Mutex    // stopped is shared with the pinging goroutines
+  isStopped := func(i int) bool {
+    mu.Lock()
+    defer mu.Unlock()
+    return stopped[i]
+  }
+  stop := func(i int) {
+    mu.Lock()
+    stopped[i] = true
+    mu.Unlock()
+  }
+
+  for i := 0; i < CRITICAL_MASS; i++ {
+    ck[i] = MakeClerk(port("replicated" + strconv.Itoa(i)), vshost, "unix")
+  }
+
+  for i := 0; i < len(ck); i++ {
+    go func(vi int){
+      for isStopped(vi) == false {
+        ck[vi].Ping(0)
+        time.Sleep(PING_INTERVAL)
+      }
+    }(i)
+  }
+
+  fmt.Printf("Test: Replicas agree on first view ...\n")
+
+  time.Sleep(PING_INTERVAL*DEAD_PINGS)
+
+  first, _ := ck[1].Get()
+  if first.ViewNumber != 1 {
+    t.Fatalf("wanted viewnumber 1, got %v", first.ViewNumber)
+  }
+  for i := 0; i < nreplicas; i++ {
+    check(t, MakeClerk(port("check"), replicas[i], "unix"), first.ShardsToPrimaries, 1)
+  }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Failure handled after leading replica dies ...\n")
+
+  vsa[0].Kill()
+  stop(0)
+
+  time.Sleep(PING_INTERVAL*DEAD_PINGS*4)
+
+  after, _ := ck[1].Get()
+  if after.ViewNumber != 2 {
+    t.Fatalf("wanted viewnumber 2, got %v", after.ViewNumber)
+  }
+  for s, p := range after.ShardsToPrimaries {
+    if p == ck[0].me {
+      t.Fatalf("dead server still primary for shard %d", s)
+    }
+  }
+  for i := 1; i < nreplicas; i++ {
+    check(t, MakeClerk(port("check"), replicas[i], "unix"), after.ShardsToPrimaries, 2)
+  }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Only the leading replica takes recovery reports ...\n")
+
+  completed := &RecoveryCompletedReply{}
+  vsa[2].RecoveryCompleted(&RecoveryCompletedArgs{ServerName: ck[1].me}, completed)
+  progress := &RecoveryProgressReply{}
+  vsa[2].RecoveryProgress(&RecoveryProgressArgs{ServerName: ck[1].me}, progress)
+  if completed.Err != ErrNotLeader || progress.Err != ErrNotLeader {
+    t.Fatalf("following replica answered recovery reports with %v, %v", completed.Err, progress.Err)
+  }
+
+  // a clerk that asks the follower first ends up at the leader
+  follower := MakeClerk(port("follower"), replicas[2] + "," + replicas[1], "unix")
+  if ! follower.RecoveryCompleted(ck[1].me, 0, 0) {
+    t.Fatalf("recovery report never reached the leading replica")
+  }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Updates give up without a majority of replicas ...\n")
+
+  vsa[2].Kill()
+
+  shard := 0
+  for s, _ := range after.ShardsToPrimaries {
+    shard = s
+  }
+  split := make(chan Err)
+  started := time.Now()
+  go func() {
+    _, err := ck[1].SplitShard(shard, "")
+    split <- err
+  }()
+
+  // the replica keeps answering while it waits for the others
+  time.Sleep(100 * time.Millisecond)
+  MakeClerk(port("check"), replicas[1], "unix").Get()
+  if time.Since(started) > COMMIT_TIMEOUT / 2 {
+    t.Fatalf("Get waited %v on a commit that can't go through", time.Since(started))
+  }
+
+  select {
+  case err := <-split:
+    if err != ErrNoMajority {
+      t.Fatalf("SplitShard without a majority returned %v", err)
+    }
+  case <-time.After(COMMIT_TIMEOUT * 3):
+    t.Fatalf("SplitShard without a majority never gave up")
+  }
+  fmt.Printf("  ... Passed\n")
+
+  for i := 0; i < len(ck); i++ {
+    stop(i)
+  }
+  vsa[1].Kill()
+}
+
+
+
+// every shard being recovered from dead has a live recovery master that isn't
+// one of the excluded servers.
+func recoveryAssigned(status StatusReply, dead string, excluded map[string]bool) bool {
+  shards := status.RecoveryInProcess[dead]
+  if len(shards) == 0 {
+    return false
+  }
+  for _, shard := range shards {
+    assigned := false
+    for rm, rmShards := range status.RecoveryMasters {
+      if rmShards[shard] && status.ServersAlive[rm] && ! excluded[rm] {
+        assigned = true
+      }
+    }
+    if ! assigned {
+      return false
+    }
+  }
+  return true
+}
+
+func TestRecoveryMasterFailure(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  vshost := port("rmfail")
+  os.Remove(JournalName(vshost))
+  vs := StartServer(vshost)
+
+  ck := make([]*Clerk, CRITICAL_MASS)
+  stopped := make([]bool, CRITICAL_MASS)
+
+  for i := 0; i < CRITICAL_MASS; i++ {
+    ck[i] = MakeClerk(port("rmfail" + strconv.Itoa(i)), vshost, "unix")
+  }
+
+  for i := 0; i < len(ck); i++ {
+    go func(vi int){
+      for stopped[vi] == false {
+        ck[vi].Ping(0)
+        time.Sleep(PING_INTERVAL)
+      }
+    }(i)
+  }
+
+  time.Sleep(PING_INTERVAL*DEAD_PINGS)
+
+  fmt.Printf("Test: Shards of a failed recovery master are reassigned ...\n")
+
+  // none of the clerks can actually act as a recovery master, so every
+  // election fails and has to be handed to somebody else.
+  dead := ck[0].me
+  stopped[0] = true
+
+  excluded := map[string]bool{dead: true}
+  var status StatusReply
+  ok := false
+  for iters := 0; iters < 50 && ! ok; iters++ {
+    time.Sleep(PING_INTERVAL)
+    status = ck[1].Status()
+    ok = time.Since(status.ServerPings[dead]) > PING_INTERVAL*DEAD_PINGS*2 && recoveryAssigned(status, dead, excluded)
+  }
+  if ! ok {
+    t.Fatalf("shards of %v lost their recovery master: %v", dead, status.RecoveryMasters)
+  }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Shards of a dead recovery master are reassigned ...\n")
+
+  for i := 1; i < len(ck); i++ {
+    if len(status.RecoveryMasters[ck[i].me]) > 0 {
+      stopped[i] = true
+      excluded[ck[i].me] = true
+      break
+    }
+  }
+
+  time.Sleep(PING_INTERVAL*DEAD_PINGS)
+
+  ok = false
+  for iters := 0; iters < 50 && ! ok; iters++ {
+    time.Sleep(PING_INTERVAL)
+    status = ck[1].Status()
+    ok = recoveryAssigned(status, dead, excluded)
+  }
+  if ! ok {
+    t.Fatalf("shards of %v lost their recovery master: %v", dead, status.RecoveryMasters)
+  }
+  fmt.Printf("  ... Passed\n")
+
+  for i := 0; i < len(ck); i++ {
+    stopped[i] = true
+  }
+  vs.Kill()
+}
+
+
+
+func TestRecoveryMasterPlacement(t *testing.T) {
+
+  fmt.Printf("Test: Recovery masters are the least loaded healthy servers ...\n")
+
+  vs := new(ViewServer)
+  vs.config = DefaultConfig()
+  vs.serverPings = make(map[string] time.Time)
+  vs.serverLoads = make(map[string] ServerLoad)
+  vs.serversAlive = make(map[string] bool)
+  vs.recoveryMasters = make(map[string]map[int]bool)
+  vs.view = View{ViewNumber: 1, ShardsToPrimaries: make(map[int] string)}
+  vs.policy = DefaultPlacementPolicy()
+  vs.policy.MaxRecoveryMasters = 2
+
+  servers := []string{"busy", "idle", "bloated", "quiet"}
+  for _, server := range servers {
+    vs.serverPings[server] = time.Now()
+    vs.serversAlive[server] = true
+  }
+
+  // busy is primary for a few shards, bloated has lots of data, and quiet
+  // hasn't pinged in a while.
+  for shard := 0; shard < 3; shard++ {
+    vs.view.ShardsToPrimaries[shard] = "busy"
+  }
+  vs.serverLoads["bloated"] = ServerLoad{StoreBytes: 1024 * 1024 * 1024}
+  vs.serverPings["quiet"] = time.Now().Add(-PING_INTERVAL * DEAD_PINGS)
+
+  assignments := vs.pickRecoveryMasters(servers, []int{10, 11, 12, 13, 14, 15})
+
+  if len(assignments) > 2 {
+    t.Fatalf("wanted at most 2 recovery masters, got %v", assignments)
+  }
+  if len(assignments["quiet"]) > 0 || len(assignments["bloated"]) > 0 {
+    t.Fatalf("loaded or suspect servers picked: %v", assignments)
+  }
+  if len(assignments["idle"]) <= len(assignments["busy"]) {
+    t.Fatalf("idle server should get the most shards: %v", assignments)
+  }
+  if len(assignments["idle"]) + len(assignments["busy"]) != 6 {
+    t.Fatalf("shards went missing: %v", assignments)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Shards of a dead recovery master are orphaned once ...\n")
+
+  vs.recoveryProgress = make(map[string] time.Time)
+  vs.failedRecoveryMasters = make(map[string] bool)
+  vs.excludedRecoveryMasters = make(map[string] time.Time)
+  vs.assigning = make(map[int] bool)
+  vs.refusedAt = make(map[string] time.Time)
+  vs.recoveryInProcess = map[string][]int{"gone": []int{20, 21}}
+  vs.recoveryMasters = map[string]map[int]bool{"idle": map[int]bool{20: true, 21: true}}
+  vs.serversAlive["idle"] = false
+
+  orphans := vs.orphanedShards()
+  if len(orphans["gone"]) != 2 {
+    t.Fatalf("shards of the dead recovery master weren't orphaned: %v", orphans)
+  }
+  for _, shard := range orphans["gone"] {
+    vs.assigning[shard] = true
+  }
+
+  // the new recovery master hasn't been committed yet
+  orphans = vs.orphanedShards()
+  if len(orphans) != 0 {
+    t.Fatalf("shards being reassigned were orphaned again: %v", orphans)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+
+func TestFailureDomains(t *testing.T) {
+
+  fmt.Printf("Test: Shards are spread across failure domains ...\n")
+
+  vs := new(ViewServer)
+  vs.domains = map[string]string{"a1": "rackA", "a2": "rackA", "b1": "rackB"}
+
+  order := vs.interleaveDomains([]string{"a1", "a2", "b1", "c1"})
+  if len(order) != 4 {
+    t.Fatalf("servers went missing: %v", order)
+  }
+  seen := make(map[string]bool)
+  for _, server := range order[:3] {
+    if seen[vs.domainOf(server)] {
+      t.Fatalf("domain %v got a second turn before the others had one: %v", vs.domainOf(server), order)
+    }
+    seen[vs.domainOf(server)] = true
+  }
+
+  // a2 and b1 have a shard each, but rackA already has three
+  counts := map[string]int{"a1": 2, "a2": 1, "b1": 1}
+  if least := vs.leastLoadedOf(counts); least != "b1" {
+    t.Fatalf("wanted b1 as least loaded, got %v", least)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+
+func TestRecoveryReports(t *testing.T) {
+
+  fmt.Printf("Test: Only the latest finished recoveries are kept ...\n")
+
+  vs := new(ViewServer)
+  vs.events = new(EventLog)
+  vs.view = View{ShardsToPrimaries: make(map[int]string)}
+  vs.recoveryInProcess = make(map[string][]int)
+  vs.deadIncarnations = make(map[string] int64)
+  vs.recoveries = make(map[string]map[int]*ShardRecovery)
+  vs.failedAt = make(map[string] time.Time)
+
+  at := time.Now()
+  for i := 0; i < RECOVERIES_KEPT + 5; i++ {
+    server := "s" + strconv.Itoa(i)
+    vs.view.ShardsToPrimaries[i] = server
+    vs.fail(server, 1, at)
+    vs.startShardRecovery(i, "master", at)
+    vs.finishShardRecovery(server, JournalEntry{Shard: i, Server: "master"}, at)
+    delete(vs.recoveryInProcess, server)
+    vs.recoveryDone(server, at)
+  }
+  if len(vs.recoveries) != RECOVERIES_KEPT || len(vs.failedAt) != RECOVERIES_KEPT {
+    t.Fatalf("wanted %d recoveries kept, got %d", RECOVERIES_KEPT, len(vs.recoveries))
+  }
+  if _, ok := vs.recoveries["s0"]; ok {
+    t.Fatalf("oldest recovery still kept")
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: A new incarnation starts with a clean report ...\n")
+
+  last := "s" + strconv.Itoa(RECOVERIES_KEPT + 4)
+  vs.fail(last, 2, at)
+  if _, ok := vs.recoveries[last]; ok {
+    t.Fatalf("report on the last incarnation of %v kept", last)
+  }
+  for _, server := range vs.recovered {
+    if server == last {
+      t.Fatalf("%v still listed as recovered", last)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+
+func TestCapacityPlacement(t *testing.T) {
+
+  fmt.Printf("Test: Big servers get proportionally more shards ...\n")
+
+  vs := new(ViewServer)
+  vs.config = DefaultConfig()
+  vs.serversAlive = map[string]bool{"big": true, "small1": true, "small2": true}
+  vs.serverLoads = make(map[string] ServerLoad)
+  vs.serverLoads["big"] = ServerLoad{Capacity: 8 << 30}
+  vs.serverLoads["small1"] = ServerLoad{Capacity: 2 << 30}
+  vs.serverLoads["small2"] = ServerLoad{Capacity: 2 << 30}
+
+  placement := vs.initialPlacement([]string{"big", "small1", "small2"})
+  counts := make(map[string]int)
+  for _, server := range placement {
+    counts[server]++
+  }
+  if len(placement) != NUMBER_OF_SHARDS {
+    t.Fatalf("wanted %d shards placed, got %d", NUMBER_OF_SHARDS, len(placement))
+  }
+  if counts["big"] < 3 * counts["small1"] || counts["big"] > 5 * counts["small1"] {
+    t.Fatalf("wanted big to have about 4x the shards of small1: %v", counts)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Rebalancing goes by capacity ...\n")
+
+  vs.view = View{ViewNumber: 1, ShardsToPrimaries: placement}
+  if _, _, _, ok := vs.pickMove(); ok {
+    t.Fatalf("placement by capacity shouldn't need rebalancing: %v", counts)
+  }
+
+  // an even split is lopsided for these servers
+  even := make(map[int]string)
+  servers := []string{"big", "small1", "small2"}
+  for shard := 0; shard < NUMBER_OF_SHARDS; shard++ {
+    even[shard] = servers[shard % len(servers)]
+  }
+  vs.view = View{ViewNumber: 1, ShardsToPrimaries: even}
+  shard, from, to, ok := vs.pickMove()
+  if ! ok || to != "big" || from == "big" {
+    t.Fatalf("wanted a shard moved to big, got %v -> %v (%v)", from, to, ok)
+  }
+
+  // a shard an operator moved stays put for a while
+  vs.pinned = map[int]time.Time{shard: time.Now().Add(PIN_TIME)}
+  if other, _, _, ok := vs.pickMove(); ok && other == shard {
+    t.Fatalf("pinned shard %d picked to move", shard)
+  }
+  vs.pinned[shard] = time.Now().Add(-time.Second)
+  if again, _, _, ok := vs.pickMove(); ! ok || again != shard {
+    t.Fatalf("shard %d not picked once its pin ran out", shard)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+
+func TestSplitShards(t *testing.T) {
+
+  fmt.Printf("Test: Split and merged shards cover every key once ...\n")
+
+  vs := new(ViewServer)
+  vs.view = View{ViewNumber: 1, NumberOfShards: 4, ShardsToPrimaries: make(map[int] string)}
+  for shard := 0; shard < 4; shard++ {
+    vs.view.ShardsToPrimaries[shard] = "p"
+  }
+
+  covered := func() {
+    for i := 0; i < 1000; i++ {
+      key := fmt.Sprintf("key%d", i)
+      shard := vs.view.ShardForKey(key)
+      if _, ok := vs.view.ShardsToPrimaries[shard]; ! ok {
+        t.Fatalf("%v is in shard %d, which isn't in the view", key, shard)
+      }
+      if shard % 4 != BaseShard(key, 4) {
+        t.Fatalf("%v moved from shard %d to %d, which wasn't split off it", key, BaseShard(key, 4), shard)
+      }
+      for s, _ := range vs.view.ShardsToPrimaries {
+        if vs.view.PartitionOf(s).Holds(key) != (s == shard) {
+          t.Fatalf("shard %d disagrees about %v being in shard %d", s, key, shard)
+        }
+      }
+    }
+
+    shards := vs.view.Shards()
+    for _, shard := range shards {
+      if _, ok := vs.view.ShardsToPrimaries[shard]; ! ok {
+        t.Fatalf("Shards() lists %d, which isn't in the view", shard)
+      }
+    }
+    if len(shards) != len(vs.view.ShardsToPrimaries) {
+      t.Fatalf("Shards() = %v; wanted those of %v", shards, vs.view.ShardsToPrimaries)
+    }
+  }
+
+  if shards := vs.splitShard(1, ""); len(shards) != 2 || shards[1] != 5 {
+    t.Fatalf("splitting shard 1 made %v", shards)
+  }
+  covered()
+  if shards := vs.splitShard(5, ""); len(shards) != 2 || shards[1] != 13 {
+    t.Fatalf("splitting shard 5 made %v", shards)
+  }
+  covered()
+
+  // 1's other half has been split since
+  if _, _, ok := vs.view.siblings(1); ok {
+    t.Fatalf("shard 1 merged with a half of its other half")
+  }
+  if _, _, ok := vs.view.siblings(2); ok {
+    t.Fatalf("shard 2 was never split")
+  }
+
+  if shards := vs.mergeShards(13); len(shards) != 2 || shards[0] != 5 {
+    t.Fatalf("merging shard 13 gave %v", shards)
+  }
+  covered()
+  if shards := vs.mergeShards(5); len(shards) != 2 || shards[0] != 1 {
+    t.Fatalf("merging shard 5 gave %v", shards)
+  }
+  covered()
+  if len(vs.view.Splits) != 0 || len(vs.view.ShardsToPrimaries) != 4 {
+    t.Fatalf("merges left %v behind: %v", vs.view.Splits, vs.view.ShardsToPrimaries)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+
+func TestRangePartitions(t *testing.T) {
+
+  fmt.Printf("Test: Ranges of keys cover every key once, in order ...\n")
+
+  vs := new(ViewServer)
+  vs.view = View{ViewNumber: 1, NumberOfShards: 10, ShardsToPrimaries: make(map[int] string)}
+  vs.view.Ranges = initialRanges(10)
+  for shard := 0; shard < 10; shard++ {
+    vs.view.ShardsToPrimaries[shard] = "p"
+  }
+
+  keys := []string{"", "\x01", " ", "0", "A", "Zebra", "a", "k0", "k1", "k10", "k2", "zz", "~~~", "\xff"}
+
+  covered := func() {
+    last := ""
+    for i, key := range keys {
+      shard := vs.view.ShardForKey(key)
+      for s, _ := range vs.view.ShardsToPrimaries {
+        if vs.view.PartitionOf(s).Holds(key) != (s == shard) {
+          t.Fatalf("shard %d disagrees about %q being in shard %d", s, key, shard)
+        }
+      }
+      start := vs.view.Ranges[shard].Start
+      if i > 0 && start < last {
+        t.Fatalf("%q is in a range before that of %q", key, keys[i-1])
+      }
+      last = start
+    }
+  }
+  covered()
+
+  for _, r := range [][2]string{{"", ""}, {"a", "b"}, {"k1", "k10"}, {"k1", "k2"}, {"", "\x00\x01"}} {
+    mid := midKey(r[0], r[1])
+    if mid == "" || ! (KeyRange{Start: r[0], End: r[1]}).Holds(mid) || mid == r[0] {
+      t.Fatalf("midKey(%q, %q) = %q", r[0], r[1], mid)
+    }
+  }
+  if mid := midKey("a", "a\x00"); mid != "" {
+    t.Fatalf("found %q between a and a\\x00", mid)
+  }
+
+  shard := vs.view.ShardForKey("k1")
+  if shards := vs.splitShard(shard, "k10"); len(shards) != 2 || shards[1] != 10 {
+    t.Fatalf("splitting shard %d made %v", shard, shards)
+  }
+  covered()
+  if vs.view.ShardForKey("k1") != shard || vs.view.ShardForKey("k10") != 10 || vs.view.ShardForKey("k2") != 10 {
+    t.Fatalf("split at k10 didn't split there: %v", vs.view.Ranges)
+  }
+
+  if shards := vs.mergeShards(shard); len(shards) != 2 || shards[0] != shard || shards[1] != 10 {
+    t.Fatalf("merging shard %d gave %v", shard, shards)
+  }
+  covered()
+  if len(vs.view.Ranges) != 10 || len(vs.view.ShardsToPrimaries) != 10 {
+    t.Fatalf("merge left %v behind", vs.view.Ranges)
+  }
+  if _, _, ok := vs.view.siblings(vs.view.ShardForKey("\xff")); ok {
+    t.Fatalf("last range has nothing after it to merge with")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+
+func TestConfig(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  fmt.Printf("Test: Config files ...\n")
+
+  fname := port("config")
+  os.WriteFile(fname, []byte(`{"PingInterval": "50ms", "NumberOfShards": 20}`), 0666)
+  config, err := LoadConfig(fname)
+  if err != nil {
+    t.Fatalf("LoadConfig: %v", err)
+  }
+  if config.PingInterval != 50 * time.Millisecond || config.NumberOfShards != 20 ||
+     config.CriticalMass != CRITICAL_MASS {
+    t.Fatalf("wrong config loaded: %+v", config)
+  }
+
+  os.WriteFile(fname, []byte(`{"CriticalMass": 2}`), 0666)
+  if _, err := LoadConfig(fname); err == nil {
+    t.Fatalf("CriticalMass no bigger than ReplicationLevel was accepted")
+  }
+  os.WriteFile(fname, []byte(`{"NumberOfShards": 65536}`), 0666)
+  if _, err := LoadConfig(fname); err == nil {
+    t.Fatalf("NumberOfShards too big to split MAX_SPLITS times was accepted")
+  }
+  os.Remove(fname)
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Servers with a different config are turned away ...\n")
+
+  config.CriticalMass = 3
+  vshost := port("vconfig")
+  os.Remove(JournalName(vshost))
+  vs := StartMe(vshost, "unix", config)
+
+  ck := make([]*Clerk, config.CriticalMass)
+  for i := 0; i < len(ck); i++ {
+    ck[i] = MakeClerk(port(strconv.Itoa(i)), vshost, "unix")
+    ck[i].SetConfig(config)
+  }
+
+  if ck[0].PingInterval() != config.PingInterval {
+    t.Fatalf("clerk backs off for %v, not the config's %v", ck[0].PingInterval(), config.PingInterval)
+  }
+
+  other := config
+  other.NumberOfShards = 30
+  stranger := MakeClerk(port("stranger"), vshost, "unix")
+  stranger.SetConfig(other)
+
+  var view View
+  var alive map[string]bool
+  for iters := 0; iters < 20 && view.ViewNumber == 0; iters++ {
+    for i := 0; i < len(ck); i++ {
+      view, alive, _ = ck[i].Ping(view.ViewNumber)
+    }
+    if _, _, err := stranger.Ping(0); err == nil {
+      t.Fatalf("ping with a different config was accepted")
+    }
+    time.Sleep(config.PingInterval)
+  }
+
+  if view.ViewNumber == 0 {
+    t.Fatalf("no view with a critical mass of %d", config.CriticalMass)
+  }
+  if view.NumberOfShards != 20 || len(view.ShardsToPrimaries) != 20 {
+    t.Fatalf("wanted 20 shards, got %d in a view of %d", len(view.ShardsToPrimaries), view.NumberOfShards)
+  }
+  if alive[stranger.me] {
+    t.Fatalf("server with a different config is alive")
+  }
+  for _, primary := range view.ShardsToPrimaries {
+    if primary == stranger.me {
+      t.Fatalf("server with a different config was given shards")
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  vs.Kill()
+}
+
+
+func TestLostSegments(t *testing.T) {
+  fmt.Printf("Test: Segments missing from a dead server's log ...\n")
+
+  // "dead" wrote segments 1, 2, 3 and 4; b1 saw the newest one
+  b1 := &QuerySegmentsReply{}
+  b1.BackedUpSegments = map[string]map[int64]map[int]bool{
+    "dead": {2: {0: true}, 4: {1: true}},
+  }
+  b1.Digests = map[string][]int64{"dead": {1, 2, 3, 4}}
+
+  b2 := &QuerySegmentsReply{}
+  b2.BackedUpSegments = map[string]map[int64]map[int]bool{
+    "dead": {1: {0: true}, 2: {0: true}},
+  }
+  b2.Digests = map[string][]int64{"dead": {1, 2}}
+
+  // unreachable backup that had segment 3
+  b3 := &QuerySegmentsReply{}
+  b3.BackedUpSegments = map[string]map[int64]map[int]bool{
+    "dead": {3: {1: true}},
+  }
+
+  missing := missingSegments("dead", []*QuerySegmentsReply{b1, b2, b3}, []bool{true, true, false})
+  if len(missing) != 1 || missing[0] != 3 {
+    t.Fatalf("wrong segments missing: %v", missing)
+  }
+
+  missing = missingSegments("dead", []*QuerySegmentsReply{b1, b2, b3}, []bool{true, true, true})
+  if len(missing) != 0 {
+    t.Fatalf("nothing should be missing: %v", missing)
+  }
+
+  missing = missingSegments("other", []*QuerySegmentsReply{b1, b2, b3}, []bool{true, true, true})
+  if len(missing) != 0 {
+    t.Fatalf("unknown server can't be missing anything: %v", missing)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+
+
 
 
 /*